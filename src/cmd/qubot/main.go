@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"app"
@@ -17,12 +18,14 @@ import (
 
 var (
 	conf    string
+	adapter string
 	version bool
 )
 
 func init() {
 	flag.BoolVar(&version, "version", false, "Show version")
 	flag.StringVar(&conf, "conf", "", "Configuration file")
+	flag.StringVar(&adapter, "adapter", "", "Chat service: slack or shell (reads messages from stdin)")
 }
 
 func main() {
@@ -41,8 +44,17 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Start service
-	q := qubot.Init(cfg)
+	// Start service. The shell adapter stops it when stdin is closed.
+	var q *qubot.Qubot
+	var eof <-chan struct{}
+	if cfg.Adapter == "shell" {
+		shell := qubot.NewShellAdapter(cfg, os.Stdin, os.Stdout)
+		eof = shell.Done()
+		q = qubot.InitWithAdapter(cfg, shell)
+	} else {
+		q = qubot.Init(cfg)
+	}
+	q.Use(qubot.Logging())
 	q.Handle(handlers.PingHandler, handlers.TauntHandler)
 	err = q.Start()
 	if err != nil {
@@ -63,12 +75,19 @@ SELECT:
 	case sig := <-sigChan:
 		switch sig {
 		case syscall.SIGINT, syscall.SIGTERM:
-			q.Close()
+			// Give the messenger a chance to deliver what is pending.
+			q.Shutdown()
 		case syscall.SIGUSR1:
 			q.Report()
 			goto SELECT
 		}
+	case <-eof:
+		q.Shutdown()
 	case <-q.Done():
+		if err := q.Err(); err != nil {
+			logger.Error("main", "Qubot stopped", "error", err)
+			os.Exit(1)
+		}
 		logger.Info("main", "Qubot stopped")
 	}
 
@@ -77,10 +96,16 @@ SELECT:
 
 func loadConfig() (*qubot.Config, error) {
 	cfg := config.DefaultConfig
+	if cfg == nil {
+		cfg = &qubot.Config{}
+	}
 
 	if conf == "" {
 		if cfgfile, err := config.File(); err == nil {
-			conf = cfgfile
+			// The shell can run without a config file.
+			if _, err := os.Stat(cfgfile); err == nil || adapter != "shell" {
+				conf = cfgfile
+			}
 		}
 	}
 
@@ -93,6 +118,14 @@ func loadConfig() (*qubot.Config, error) {
 		logger.Info("main", "Using config file", "path", conf)
 	}
 
+	if adapter != "" {
+		cfg.Adapter = adapter
+	}
+	// The shell does not need a config file, its database is disposable.
+	if cfg.Adapter == "shell" && cfg.Database == nil {
+		cfg.Database = &qubot.DatabaseConfig{Location: filepath.Join(os.TempDir(), "qubot-shell.db")}
+	}
+
 	return cfg, config.Validate(cfg)
 }
 
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"qubot"
+	"testutil"
+)
+
+// load writes the configuration to a temporary file and loads it.
+func load(t *testing.T, data string) (*qubot.Config, error) {
+	path := testutil.Tempfile()
+	testutil.Ok(t, ioutil.WriteFile(path, []byte(data), 0600))
+	defer os.Remove(path)
+	return Load(path)
+}
+
+// Ensure that every section of the configuration file is decoded.
+func TestLoad(t *testing.T) {
+	c, err := load(t, `
+database {
+	location = "/var/lib/qubot/qubot.db"
+}
+
+slack {
+	nickname = "qubot"
+	key = "xoxb-test"
+}
+
+redmine {
+	url = "https://redmine.example.com"
+	key = "secret"
+}
+
+messenger {
+	rate = 2.0
+	burst = 3
+	channelrate = 0.5
+	channelburst = 1
+	shutdowntimeout = "5s"
+	outboxmaxage = "1h"
+}
+
+dispatcher {
+	workers = 4
+	queuesize = 16
+	eventtimeout = "2s"
+}
+
+filters {
+	users = ["U123"]
+	allbots = true
+	channels = ["#random"]
+}
+`)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Validate(c))
+
+	testutil.Equals(t, "/var/lib/qubot/qubot.db", c.Database.Location)
+	testutil.Equals(t, &qubot.MessengerConfig{
+		Rate:            2,
+		Burst:           3,
+		ChannelRate:     0.5,
+		ChannelBurst:    1,
+		ShutdownTimeout: "5s",
+		OutboxMaxAge:    "1h",
+	}, c.Messenger)
+	testutil.Equals(t, &qubot.DispatcherConfig{Workers: 4, QueueSize: 16, EventTimeout: "2s"}, c.Dispatcher)
+	testutil.Equals(t, []string{"U123"}, c.Filters.Users)
+	testutil.Equals(t, true, c.Filters.AllBots)
+	testutil.Equals(t, []string{"#random"}, c.Filters.Channels)
+}
+
+// Ensure that non-positive timeouts are rejected instead of being replaced by
+// the defaults.
+func TestValidate_timeouts(t *testing.T) {
+	for _, d := range []string{"0s", "-5s"} {
+		c := &qubot.Config{
+			Adapter:    "shell",
+			Database:   &qubot.DatabaseConfig{Location: "qubot.db"},
+			Messenger:  &qubot.MessengerConfig{ShutdownTimeout: d},
+			Dispatcher: &qubot.DispatcherConfig{EventTimeout: d},
+		}
+		err := Validate(c)
+		testutil.Assert(t, err != nil, "timeout %s accepted", d)
+		testutil.Assert(t, strings.Contains(err.Error(), "dispatcher: eventtimeout must be positive"), "unexpected error: %s", err)
+		testutil.Assert(t, strings.Contains(err.Error(), "messenger: shutdowntimeout must be positive"), "unexpected error: %s", err)
+	}
+}
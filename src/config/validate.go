@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"qubot"
 
@@ -15,11 +16,19 @@ func Validate(c *qubot.Config) error {
 	if c.Database == nil {
 		result = multierror.Append(result, fmt.Errorf("'database' configuration section is missing"))
 	}
-	if c.Slack == nil {
-		result = multierror.Append(result, fmt.Errorf("'slack' configuration section is missing"))
-	}
-	if c.Redmine == nil {
-		result = multierror.Append(result, fmt.Errorf("'redmine' configuration section is missing"))
+
+	// The shell adapter runs offline, Slack and Redmine are not needed.
+	switch c.Adapter {
+	case "", "slack":
+		if c.Slack == nil {
+			result = multierror.Append(result, fmt.Errorf("'slack' configuration section is missing"))
+		}
+		if c.Redmine == nil {
+			result = multierror.Append(result, fmt.Errorf("'redmine' configuration section is missing"))
+		}
+	case "shell":
+	default:
+		result = multierror.Append(result, fmt.Errorf("adapter: %q is not supported", c.Adapter))
 	}
 
 	if c.Slack != nil {
@@ -40,5 +49,41 @@ func Validate(c *qubot.Config) error {
 		}
 	}
 
+	if c.Messenger != nil {
+		if c.Messenger.Rate < 0 || c.Messenger.ChannelRate < 0 {
+			result = multierror.Append(result, fmt.Errorf("messenger: rates can not be negative"))
+		}
+		if c.Messenger.Burst < 0 || c.Messenger.ChannelBurst < 0 {
+			result = multierror.Append(result, fmt.Errorf("messenger: bursts can not be negative"))
+		}
+		if c.Messenger.ShutdownTimeout != "" {
+			if d, err := time.ParseDuration(c.Messenger.ShutdownTimeout); err != nil {
+				result = multierror.Append(result, fmt.Errorf("messenger: shutdowntimeout is not valid: %s", err))
+			} else if d <= 0 {
+				result = multierror.Append(result, fmt.Errorf("messenger: shutdowntimeout must be positive"))
+			}
+		}
+		if c.Messenger.OutboxMaxAge != "" {
+			if d, err := time.ParseDuration(c.Messenger.OutboxMaxAge); err != nil {
+				result = multierror.Append(result, fmt.Errorf("messenger: outboxmaxage is not valid: %s", err))
+			} else if d <= 0 {
+				result = multierror.Append(result, fmt.Errorf("messenger: outboxmaxage must be positive"))
+			}
+		}
+	}
+
+	if c.Dispatcher != nil {
+		if c.Dispatcher.Workers < 0 || c.Dispatcher.QueueSize < 0 {
+			result = multierror.Append(result, fmt.Errorf("dispatcher: workers and queuesize can not be negative"))
+		}
+		if c.Dispatcher.EventTimeout != "" {
+			if d, err := time.ParseDuration(c.Dispatcher.EventTimeout); err != nil {
+				result = multierror.Append(result, fmt.Errorf("dispatcher: eventtimeout is not valid: %s", err))
+			} else if d <= 0 {
+				result = multierror.Append(result, fmt.Errorf("dispatcher: eventtimeout must be positive"))
+			}
+		}
+	}
+
 	return result
 }
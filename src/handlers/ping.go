@@ -13,12 +13,17 @@ var PingHandler *pingHandler
 
 func init() {
 	PingHandler = &pingHandler{
-		done: make(chan struct{}),
+		Router: qubot.NewRouter(),
+		done:   make(chan struct{}),
 	}
+	PingHandler.RequireAddress()
+	PingHandler.Command("ping", PingHandler.ping)
 }
 
-// pingHandler implements the Handler interface.
+// pingHandler implements the Handler interface. Handle and Match are provided
+// by the embedded router.
 type pingHandler struct {
+	*qubot.Router
 	ctx  context.Context
 	done chan struct{}
 }
@@ -36,6 +41,7 @@ func (h *pingHandler) Start(ctx context.Context) error {
 	}
 }
 
-func (h *pingHandler) Handle(r qubot.Response, msg *qubot.Message) {
-	logger.Debug("pingHandler", "Received a message!")
+func (h *pingHandler) ping(ctx context.Context, r qubot.Response, msg *qubot.Message, _ *qubot.Args) {
+	logger.Debug("pingHandler", "Received a ping!")
+	r.Reply("pong")
 }
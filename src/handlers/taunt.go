@@ -36,6 +36,6 @@ func (h *tauntHandler) Start(ctx context.Context) error {
 	}
 }
 
-func (h *tauntHandler) Handle(r qubot.Response, msg *qubot.Message) {
+func (h *tauntHandler) Handle(ctx context.Context, r qubot.Response, msg *qubot.Message) {
 	logger.Debug("tauntHandler", "Received a message!")
 }
@@ -0,0 +1,83 @@
+package qubot
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+// An Adapter connects Qubot to a chat service. It translates what the service
+// sends into Messages and Events, posts the messages of the bot and keeps the
+// directory of users and channels, so Qubot and its handlers do not depend on
+// the service they are running on. Slack is the default adapter, see Init.
+//
+// The Messenger of the adapter can not be used before it is connected. The
+// adapter reports the changes of the state of its connection with a
+// ConnectionEvent, Qubot shuts down when the connection fails for good.
+type Adapter interface {
+	Messenger
+
+	// Name returns the name of the chat service, e.g. "slack".
+	Name() string
+
+	// Connect validates the credentials and connects to the chat service
+	// without blocking. The adapter delivers events until the context is
+	// done.
+	Connect(ctx context.Context) error
+
+	// Events returns the channel where the adapter delivers the messages
+	// received, as *Message, and the rest of events, as Event. The users
+	// and channels of both are resolved with the directory of the adapter.
+	Events() <-chan interface{}
+
+	// Me returns the user of the bot, or nil when it is not known yet.
+	Me() *User
+
+	// User returns the user with the ID given. A user with just the ID is
+	// returned when it is not known.
+	User(id string) *User
+
+	// Channel returns the channel with the ID or the name given, see
+	// Qubot.Channel.
+	Channel(id string) (*Channel, bool)
+
+	// Channels returns the channels known by the adapter sorted by name.
+	Channels() []*Channel
+}
+
+// OutgoingMessage is a message posted by the bot. The channel can be a user ID
+// to send a direct message to the user.
+//
+// Attachments, Broadcast, Username and the icons are rich features that plain
+// messages lack, the chat service may need a different path to post them, see
+// Rich.
+type OutgoingMessage struct {
+	Channel         string
+	Text            string
+	ThreadTimestamp string
+
+	// Attachments add structured content after the text, e.g. the card of
+	// an issue.
+	Attachments []Attachment
+	// Broadcast shows a reply posted in a thread in the channel too.
+	Broadcast bool
+	// Username, IconURL and IconEmoji change how the bot is shown for this
+	// message only.
+	Username  string
+	IconURL   string
+	IconEmoji string
+}
+
+// Rich reports whether the message uses any feature beyond plain text.
+func (msg *OutgoingMessage) Rich() bool {
+	return len(msg.Attachments) > 0 || msg.Broadcast ||
+		msg.Username != "" || msg.IconURL != "" || msg.IconEmoji != ""
+}
+
+// errNotConnected is returned when a message is sent before the adapter is
+// connected.
+var errNotConnected = errors.New("adapter: not connected")
+
+// ErrInvalidAuth is the reason of the failure of the connection when the
+// credentials are rejected by the chat service.
+var ErrInvalidAuth = errors.New("adapter: invalid credentials")
@@ -0,0 +1,71 @@
+package qubot
+
+import (
+	"testing"
+	"time"
+
+	"testutil"
+
+	"golang.org/x/net/context"
+)
+
+// fakeAdapter implements the Adapter interface, the tests push messages and
+// events through its events channel and the messages sent are kept by its
+// messenger.
+type fakeAdapter struct {
+	fakeMessenger
+	events chan interface{}
+}
+
+func newFakeAdapter() *fakeAdapter {
+	return &fakeAdapter{events: make(chan interface{}, 10)}
+}
+
+func (a *fakeAdapter) Name() string                      { return "fake" }
+func (a *fakeAdapter) Connect(ctx context.Context) error { return nil }
+func (a *fakeAdapter) Events() <-chan interface{}        { return a.events }
+func (a *fakeAdapter) Me() *User                         { return &User{ID: "B001", Name: "qubot"} }
+func (a *fakeAdapter) User(id string) *User              { return &User{ID: id} }
+func (a *fakeAdapter) Channel(id string) (*Channel, bool) {
+	return nil, false
+}
+func (a *fakeAdapter) Channels() []*Channel { return nil }
+
+// Ensure that Qubot runs on any adapter.
+func TestQubot_adapter(t *testing.T) {
+	q := InitTestQubot()
+	a := newFakeAdapter()
+	q.a = a
+	h := &msgHandler{msgs: make(chan *Message, 10)}
+	q.Handle(h, &replyHandler{})
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	a.events <- &Message{
+		User:    &User{ID: "B001"},
+		Channel: &Channel{ID: "#general"},
+		RawText: "echo",
+	}
+	a.events <- &Message{
+		User:    &User{ID: "alice"},
+		Channel: &Channel{ID: "#general"},
+		RawText: "<@B001> ping",
+	}
+
+	select {
+	case msg := <-h.msgs:
+		testutil.Equals(t, "ping", msg.Text)
+		testutil.Assert(t, msg.IsMention, "message should be addressed to the bot")
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not handled")
+	}
+	// The echo of the bot is ignored.
+	select {
+	case msg := <-h.msgs:
+		t.Fatalf("unexpected message: %s", msg.RawText)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	q.Shutdown()
+	testutil.Equals(t, []string{"You said: <@B001> ping"}, a.texts())
+}
@@ -0,0 +1,289 @@
+package qubot
+
+import (
+	"logger"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Channel implements the Adapter interface.
+func (s *slackAdapter) Channel(id string) (*Channel, bool) {
+	name := strings.TrimPrefix(id, "#")
+
+	s.cmux.Lock()
+	defer s.cmux.Unlock()
+
+	if c, ok := s.channels[id]; ok {
+		return copyChannel(c), true
+	}
+	for _, c := range s.channels {
+		if c.Name == name {
+			return copyChannel(c), true
+		}
+	}
+	return nil, false
+}
+
+// Channels implements the Adapter interface.
+func (s *slackAdapter) Channels() []*Channel {
+	s.cmux.Lock()
+	defer s.cmux.Unlock()
+
+	channels := make([]*Channel, 0, len(s.channels))
+	for _, c := range s.channels {
+		channels = append(channels, copyChannel(c))
+	}
+	sort.Sort(channelsByName(channels))
+	return channels
+}
+
+type channelsByName []*Channel
+
+func (s channelsByName) Len() int           { return len(s) }
+func (s channelsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s channelsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// channel returns the channel with the ID given, from the cache of channels
+// or from the database. When the channel is not known, its name is left empty
+// and its type is guessed from the ID.
+func (s *slackAdapter) channel(id string) *Channel {
+	s.cmux.Lock()
+	defer s.cmux.Unlock()
+
+	if c := s.loadChannel(id); c != nil {
+		return copyChannel(c)
+	}
+	return &Channel{ID: id, Type: channelType(id)}
+}
+
+// loadChannel returns the channel from the cache, or from the database when
+// it is not cached yet, or nil. The caller must hold cmux.
+func (s *slackAdapter) loadChannel(id string) *Channel {
+	if c, ok := s.channels[id]; ok {
+		return c
+	}
+	if isIMChannel(id) {
+		return nil
+	}
+	var c *Channel
+	err := s.db.View(func(tx *Tx) error {
+		var err error
+		c, err = tx.Channel(id)
+		return err
+	})
+	if err != nil {
+		logger.Warn("qubot", "Channel lookup failed", "channel", id, "error", err)
+	}
+	if c != nil {
+		s.channels[id] = c
+	}
+	return c
+}
+
+// syncChannels saves the public and private channels of the team. The bot is
+// a member of all the private channels it knows about. The channels that are
+// gone, because they were deleted or the bot left them while it was
+// disconnected, are updated too.
+func (s *slackAdapter) syncChannels(info *slack.Info) {
+	seen := make(map[string]bool)
+	for _, ch := range info.Channels {
+		seen[ch.ID] = true
+		s.saveChannel(&Channel{
+			ID:       ch.ID,
+			Name:     ch.Name,
+			Type:     PublicChannel,
+			Topic:    ch.Topic.Value,
+			Purpose:  ch.Purpose.Value,
+			Members:  ch.Members,
+			IsMember: ch.IsMember,
+			Archived: ch.IsArchived,
+			Creation: ch.Created.Time(),
+		})
+	}
+	for _, g := range info.Groups {
+		seen[g.ID] = true
+		s.saveChannel(&Channel{
+			ID:       g.ID,
+			Name:     g.Name,
+			Type:     PrivateChannel,
+			Topic:    g.Topic.Value,
+			Purpose:  g.Purpose.Value,
+			Members:  g.Members,
+			IsMember: true,
+			Archived: g.IsArchived,
+			Creation: g.Created.Time(),
+		})
+	}
+
+	var known []*Channel
+	err := s.db.View(func(tx *Tx) (err error) {
+		known, err = tx.Channels()
+		return err
+	})
+	if err != nil {
+		logger.Error("qubot", "Channels could not be listed", "error", err)
+	}
+	for _, c := range known {
+		if seen[c.ID] {
+			continue
+		}
+		switch {
+		case c.Type == PublicChannel:
+			err = s.deleteChannel(c.ID)
+		case c.IsMember:
+			err = s.setMember(c.ID, false)
+		}
+		if err != nil {
+			logger.Error("qubot", "Channel could not be updated", "channel", c.ID, "error", err)
+		}
+	}
+
+	s.cmux.Lock()
+	defer s.cmux.Unlock()
+	logger.Info("qubot", "Channels have been identified", "count", len(s.channels))
+}
+
+// saveChannel replaces the channel in the cache and in the database.
+func (s *slackAdapter) saveChannel(c *Channel) {
+	err := s.updateChannel(c.ID, func(prev *Channel) {
+		*prev = *c
+	})
+	if err != nil {
+		logger.Error("qubot", "Channel could not be saved", "channel", c.ID, "error", err)
+	}
+}
+
+// updateChannel applies the changes made by fn to the channel, which is
+// created when it is not known yet, and saves it.
+func (s *slackAdapter) updateChannel(id string, fn func(*Channel)) error {
+	s.cmux.Lock()
+	defer s.cmux.Unlock()
+
+	c := s.loadChannel(id)
+	if c == nil {
+		c = &Channel{ID: id, Type: channelType(id), Creation: time.Now()}
+	} else {
+		c = copyChannel(c)
+	}
+	fn(c)
+	s.channels[id] = c
+	return s.db.Update(func(tx *Tx) error {
+		return tx.SaveChannel(c)
+	})
+}
+
+// deleteChannel removes the channel from the cache and from the database.
+func (s *slackAdapter) deleteChannel(id string) error {
+	s.cmux.Lock()
+	defer s.cmux.Unlock()
+
+	delete(s.channels, id)
+	return s.db.Update(func(tx *Tx) error {
+		return tx.DeleteChannel(id)
+	})
+}
+
+// onChannelEvent keeps the channels up to date when they are created,
+// renamed, archived or deleted and when the bot joins or leaves them.
+func (s *slackAdapter) onChannelEvent(event interface{}) error {
+	switch e := event.(type) {
+	case *slack.ChannelCreatedEvent:
+		return s.updateChannel(e.Channel.ID, func(c *Channel) {
+			c.Name, c.Type = e.Channel.Name, PublicChannel
+		})
+	case *slack.ChannelJoinedEvent:
+		return s.onJoinedEvent(&e.Channel, PublicChannel)
+	case *slack.GroupJoinedEvent:
+		return s.onJoinedEvent(&e.Channel, PrivateChannel)
+	case *slack.ChannelLeftEvent:
+		return s.setMember(e.Channel, false)
+	case *slack.GroupLeftEvent:
+		return s.setMember(e.Channel, false)
+	case *slack.ChannelRenameEvent:
+		return s.updateChannel(e.Channel.ID, func(c *Channel) { c.Name = e.Channel.Name })
+	case *slack.GroupRenameEvent:
+		return s.updateChannel(e.Group.ID, func(c *Channel) { c.Name = e.Group.Name })
+	case *slack.ChannelArchiveEvent:
+		return s.setArchived(e.Channel, true)
+	case *slack.GroupArchiveEvent:
+		return s.setArchived(e.Channel, true)
+	case *slack.ChannelUnarchiveEvent:
+		return s.setArchived(e.Channel, false)
+	case *slack.GroupUnarchiveEvent:
+		return s.setArchived(e.Channel, false)
+	case *slack.ChannelDeletedEvent:
+		return s.deleteChannel(e.Channel)
+	}
+	return nil
+}
+
+// onJoinedEvent saves the channel that the bot has joined.
+func (s *slackAdapter) onJoinedEvent(ch *slack.Channel, t ChannelType) error {
+	return s.updateChannel(ch.ID, func(c *Channel) {
+		c.Name, c.Type = ch.Name, t
+		c.Topic, c.Purpose = ch.Topic.Value, ch.Purpose.Value
+		c.Members = ch.Members
+		c.IsMember = true
+		c.Archived = ch.IsArchived
+	})
+}
+
+func (s *slackAdapter) setMember(id string, member bool) error {
+	return s.updateChannel(id, func(c *Channel) { c.IsMember = member })
+}
+
+func (s *slackAdapter) setArchived(id string, archived bool) error {
+	return s.updateChannel(id, func(c *Channel) { c.Archived = archived })
+}
+
+// onChannelMessage tracks the members, the topic and the purpose of the
+// channels from the messages that Slack posts when they change. The Slack
+// library we use predates the member_joined_channel event, the channel_join
+// message is sent to the channel in its place.
+func (s *slackAdapter) onChannelMessage(e *slack.MessageEvent) error {
+	switch e.SubType {
+	case "channel_join", "group_join":
+		return s.updateChannel(e.Channel, func(c *Channel) {
+			c.Members = addMember(c.Members, e.User)
+		})
+	case "channel_leave", "group_leave":
+		return s.updateChannel(e.Channel, func(c *Channel) {
+			c.Members = removeMember(c.Members, e.User)
+		})
+	case "channel_topic", "group_topic":
+		return s.updateChannel(e.Channel, func(c *Channel) { c.Topic = e.Topic })
+	case "channel_purpose", "group_purpose":
+		return s.updateChannel(e.Channel, func(c *Channel) { c.Purpose = e.Purpose })
+	}
+	return nil
+}
+
+func addMember(members []string, id string) []string {
+	for _, m := range members {
+		if m == id {
+			return members
+		}
+	}
+	return append(members, id)
+}
+
+func removeMember(members []string, id string) []string {
+	var res []string
+	for _, m := range members {
+		if m != id {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// copyChannel returns a copy of the channel that can be modified without
+// affecting the cache.
+func copyChannel(c *Channel) *Channel {
+	cp := *c
+	cp.Members = append([]string(nil), c.Members...)
+	return &cp
+}
@@ -1,10 +1,21 @@
 package qubot
 
-// Config is the conguration of Qubot.
+import (
+	"strings"
+	"time"
+)
+
+// Config is the conguration of Qubot. Adapter is the chat service that Qubot
+// runs on, "slack" or "shell", Slack when it is empty.
 type Config struct {
-	Database *DatabaseConfig
-	Slack    *SlackConfig
-	Redmine  *RedmineConfig
+	Adapter    string
+	Database   *DatabaseConfig
+	Slack      *SlackConfig
+	Shell      *ShellConfig
+	Redmine    *RedmineConfig
+	Messenger  *MessengerConfig
+	Dispatcher *DispatcherConfig
+	Filters    *FiltersConfig
 }
 
 // DatabaseConfig is the database configuration.
@@ -18,6 +29,13 @@ type SlackConfig struct {
 	Key      string
 }
 
+// ShellConfig holds the names of the fake user and channel of the messages
+// typed in the shell, see ShellAdapter.
+type ShellConfig struct {
+	User    string
+	Channel string
+}
+
 // RedmineConfig is the configuration of Redmine.
 type RedmineConfig struct {
 	URL           string
@@ -25,3 +43,117 @@ type RedmineConfig struct {
 	User          string
 	VerifyTLSCert bool
 }
+
+// MessengerConfig holds the rate limits used to post messages. Rates are given
+// in messages per second and bursts are the number of messages that can be
+// posted at once. The configuration file only takes rates with a decimal
+// point, e.g. "rate = 2.0". ShutdownTimeout is a duration string, e.g. "10s",
+// that bounds how long we wait for the pending messages when shutting down.
+// OutboxMaxAge is a duration string too, the messages left in the outbox that
+// are older than it are not posted after a start.
+type MessengerConfig struct {
+	Rate            float64
+	Burst           int
+	ChannelRate     float64
+	ChannelBurst    int
+	ShutdownTimeout string
+	OutboxMaxAge    string
+}
+
+// shutdownTimeout returns the configured shutdown timeout or the default one
+// when it is missing or not valid.
+func (c *MessengerConfig) shutdownTimeout() time.Duration {
+	if c == nil || c.ShutdownTimeout == "" {
+		return msnShutdownTimeout
+	}
+	d, err := time.ParseDuration(c.ShutdownTimeout)
+	if err != nil || d <= 0 {
+		return msnShutdownTimeout
+	}
+	return d
+}
+
+// outboxMaxAge returns the configured age limit of the messages of the outbox
+// or the default one when it is missing or not valid.
+func (c *MessengerConfig) outboxMaxAge() time.Duration {
+	if c == nil || c.OutboxMaxAge == "" {
+		return msnOutboxMaxAge
+	}
+	d, err := time.ParseDuration(c.OutboxMaxAge)
+	if err != nil || d <= 0 {
+		return msnOutboxMaxAge
+	}
+	return d
+}
+
+// DispatcherConfig holds the settings of the pool of workers that handle the
+// events received from Slack. QueueSize is the number of events that each
+// worker can hold before the reception of new events is blocked.
+// EventTimeout is a duration string, e.g. "10s", that bounds the time given to
+// the handlers of an event.
+type DispatcherConfig struct {
+	Workers      int
+	QueueSize    int
+	EventTimeout string
+}
+
+// eventTimeout returns the configured event timeout or the default one when it
+// is missing or not valid.
+func (c *DispatcherConfig) eventTimeout() time.Duration {
+	if c == nil || c.EventTimeout == "" {
+		return dspEventTimeout
+	}
+	d, err := time.ParseDuration(c.EventTimeout)
+	if err != nil || d <= 0 {
+		return dspEventTimeout
+	}
+	return d
+}
+
+// FiltersConfig lists the senders whose messages are ignored before they reach
+// the handlers. Users and Channels are given by ID or name, Bots by bot ID or
+// username. AllBots makes Qubot ignore the messages of every bot. Slackbot
+// and Qubot itself are always ignored.
+type FiltersConfig struct {
+	Users    []string
+	Bots     []string
+	AllBots  bool
+	Channels []string
+}
+
+// ignoreUser returns true if the messages of the user must be ignored.
+func (c *FiltersConfig) ignoreUser(id, name string) bool {
+	if matchAny(ignoreUserList, id, name) {
+		return true
+	}
+	return c != nil && matchAny(c.Users, id, name)
+}
+
+// ignoreBot returns true if the messages of the bot must be ignored.
+func (c *FiltersConfig) ignoreBot(id, username string) bool {
+	return c != nil && (c.AllBots || matchAny(c.Bots, id, username))
+}
+
+// ignoreChannel returns true if the messages sent to the channel must be
+// ignored. Channel names can be given with or without the leading hash.
+func (c *FiltersConfig) ignoreChannel(id, name string) bool {
+	if c == nil {
+		return false
+	}
+	for _, ch := range c.Channels {
+		if ch == id || (name != "" && strings.TrimPrefix(ch, "#") == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny returns true if the list contains the ID or the name given.
+func matchAny(list []string, id, name string) bool {
+	for _, item := range list {
+		if (id != "" && item == id) || (name != "" && item == name) {
+			return true
+		}
+	}
+	return false
+}
@@ -31,6 +31,8 @@ func (db *DB) init() error {
 	return db.Update(func(tx *Tx) error {
 		_, _ = tx.CreateBucketIfNotExists([]byte("meta"))
 		_, _ = tx.CreateBucketIfNotExists([]byte("users"))
+		_, _ = tx.CreateBucketIfNotExists([]byte("channels"))
+		_, _ = tx.CreateBucketIfNotExists([]byte("outbox"))
 
 		return nil
 	})
@@ -55,8 +57,10 @@ type Tx struct {
 	*bolt.Tx
 }
 
-func (tx *Tx) meta() *bolt.Bucket  { return tx.Bucket([]byte("meta")) }
-func (tx *Tx) users() *bolt.Bucket { return tx.Bucket([]byte("users")) }
+func (tx *Tx) meta() *bolt.Bucket     { return tx.Bucket([]byte("meta")) }
+func (tx *Tx) users() *bolt.Bucket    { return tx.Bucket([]byte("users")) }
+func (tx *Tx) channels() *bolt.Bucket { return tx.Bucket([]byte("channels")) }
+func (tx *Tx) outbox() *bolt.Bucket   { return tx.Bucket([]byte("outbox")) }
 
 // Meta retrieves a meta field by name.
 func (tx *Tx) Meta(key string) string {
@@ -91,6 +95,89 @@ func (tx *Tx) SaveUser(u *User) error {
 	return tx.users().Put([]byte(u.ID), b)
 }
 
+// Channel retrieves a channel from the database by ID.
+func (tx *Tx) Channel(id string) (c *Channel, err error) {
+	if v := tx.channels().Get([]byte(id)); v != nil {
+		err = json.Unmarshal(v, &c)
+	}
+	return
+}
+
+// Channels retrieves all the channels from the database sorted by ID.
+func (tx *Tx) Channels() ([]*Channel, error) {
+	var channels []*Channel
+	err := tx.channels().ForEach(func(k, v []byte) error {
+		var c *Channel
+		if err := json.Unmarshal(v, &c); err != nil {
+			return fmt.Errorf("unmarshal channel: %s", err)
+		}
+		channels = append(channels, c)
+		return nil
+	})
+	return channels, err
+}
+
+// SaveChannel stores a channel in the database.
+func (tx *Tx) SaveChannel(c *Channel) error {
+	if c == nil {
+		panic("nil channel")
+	}
+	if c.ID == "" {
+		panic("channel id required")
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("marshal channel: %s", err)
+	}
+	return tx.channels().Put([]byte(c.ID), b)
+}
+
+// DeleteChannel removes a channel from the database.
+func (tx *Tx) DeleteChannel(id string) error {
+	return tx.channels().Delete([]byte(id))
+}
+
+// OutboxMessages retrieves the messages waiting to be delivered in the order
+// they were saved.
+func (tx *Tx) OutboxMessages() ([]*OutboxMessage, error) {
+	var msgs []*OutboxMessage
+	err := tx.outbox().ForEach(func(k, v []byte) error {
+		var m *OutboxMessage
+		if err := json.Unmarshal(v, &m); err != nil {
+			return fmt.Errorf("unmarshal outbox message: %s", err)
+		}
+		m.Seq = btoi64(k)
+		msgs = append(msgs, m)
+		return nil
+	})
+	return msgs, err
+}
+
+// SaveOutboxMessage stores a message waiting to be delivered. The message is
+// given a sequence number when it does not have one yet.
+func (tx *Tx) SaveOutboxMessage(m *OutboxMessage) error {
+	if m == nil {
+		panic("nil outbox message")
+	}
+	if m.Seq == 0 {
+		seq, err := tx.outbox().NextSequence()
+		if err != nil {
+			return err
+		}
+		m.Seq = int64(seq)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshal outbox message: %s", err)
+	}
+	return tx.outbox().Put(i64tob(m.Seq), b)
+}
+
+// DeleteOutboxMessage removes a message from the outbox.
+func (tx *Tx) DeleteOutboxMessage(seq int64) error {
+	return tx.outbox().Delete(i64tob(seq))
+}
+
 // Converts an integer to a big-endian encoded byte slice.
 func i64tob(v int64) []byte {
 	var b = make([]byte, 8)
@@ -98,10 +185,51 @@ func i64tob(v int64) []byte {
 	return b
 }
 
-// User of the organization.
+// Converts a big-endian encoded byte slice to an integer.
+func btoi64(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// User of the organization. Deleted users are kept so their history can
+// still be attributed to them. BotID is only set for bot users, it
+// identifies the messages they post as bot_message.
 type User struct {
 	ID       string    `json:"id"`
 	Name     string    `json:"name"`
+	RealName string    `json:"real_name"`
 	Email    string    `json:"email"`
+	TimeZone string    `json:"time_zone"`
+	BotID    string    `json:"bot_id,omitempty"`
+	IsAdmin  bool      `json:"is_admin"`
+	Deleted  bool      `json:"deleted"`
 	Creation time.Time `json:"creation"`
 }
+
+// Channel of the organization. IsMember tells whether Qubot is a member of
+// the channel, Members lists the IDs of its members.
+type Channel struct {
+	ID       string      `json:"id"`
+	Name     string      `json:"name"`
+	Type     ChannelType `json:"type"`
+	Topic    string      `json:"topic"`
+	Purpose  string      `json:"purpose"`
+	Members  []string    `json:"members"`
+	IsMember bool        `json:"is_member"`
+	Archived bool        `json:"archived"`
+	Creation time.Time   `json:"creation"`
+}
+
+// OutboxMessage is a message waiting to be delivered to Slack.
+type OutboxMessage struct {
+	Seq             int64     `json:"-"`
+	Channel         string    `json:"channel"`
+	Text            string    `json:"text"`
+	ThreadTimestamp string    `json:"thread_ts,omitempty"`
+	Creation        time.Time `json:"creation"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Broadcast   bool         `json:"reply_broadcast,omitempty"`
+	Username    string       `json:"username,omitempty"`
+	IconURL     string       `json:"icon_url,omitempty"`
+	IconEmoji   string       `json:"icon_emoji,omitempty"`
+}
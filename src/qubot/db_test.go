@@ -59,6 +59,68 @@ func TestTx_SaveUser(t *testing.T) {
 	}))
 }
 
+// Ensure that outbox messages are kept in order and can be removed.
+func TestTx_SaveOutboxMessage(t *testing.T) {
+	db := NewTestDB()
+	defer db.Close()
+
+	msgs := []*OutboxMessage{
+		{Channel: "C100", Text: "foo", Creation: time.Now().UTC()},
+		{Channel: "C200", Text: "bar", ThreadTimestamp: "1000.01", Creation: time.Now().UTC()},
+		{Channel: "C100", Text: "baz", Creation: time.Now().UTC()},
+	}
+	testutil.Ok(t, db.Update(func(tx *Tx) error {
+		for _, m := range msgs {
+			testutil.Ok(t, tx.SaveOutboxMessage(m))
+		}
+		return nil
+	}))
+	testutil.Equals(t, []int64{1, 2, 3}, []int64{msgs[0].Seq, msgs[1].Seq, msgs[2].Seq})
+
+	testutil.Ok(t, db.Update(func(tx *Tx) error {
+		return tx.DeleteOutboxMessage(msgs[1].Seq)
+	}))
+
+	testutil.Ok(t, db.View(func(tx *Tx) error {
+		got, err := tx.OutboxMessages()
+		testutil.Ok(t, err)
+		testutil.Equals(t, []*OutboxMessage{msgs[0], msgs[2]}, got)
+		return nil
+	}))
+}
+
+// Ensure that channels can be saved, listed and deleted.
+func TestTx_SaveChannel(t *testing.T) {
+	db := NewTestDB()
+	defer db.Close()
+
+	testutil.Ok(t, db.Update(func(tx *Tx) error {
+		testutil.Ok(t, tx.SaveChannel(&Channel{ID: "C200", Name: "random"}))
+		return tx.SaveChannel(&Channel{ID: "C100", Name: "general", Members: []string{"U100"}, IsMember: true})
+	}))
+	testutil.Ok(t, db.View(func(tx *Tx) error {
+		c, err := tx.Channel("C100")
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"U100"}, c.Members)
+		testutil.Assert(t, c.IsMember, "bot should be a member")
+
+		channels, err := tx.Channels()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 2, len(channels))
+		testutil.Equals(t, "C100", channels[0].ID)
+		return nil
+	}))
+	testutil.Ok(t, db.Update(func(tx *Tx) error {
+		return tx.DeleteChannel("C100")
+	}))
+	testutil.Ok(t, db.View(func(tx *Tx) error {
+		c, err := tx.Channel("C100")
+		testutil.Ok(t, err)
+		testutil.Assert(t, c == nil, "channel should be deleted")
+		return nil
+	}))
+}
+
 // TestDB wraps the DB to provide helper functions and clean up.
 type TestDB struct {
 	*DB
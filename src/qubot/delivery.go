@@ -0,0 +1,113 @@
+package qubot
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// errAckTimeout is returned when Slack does not acknowledge a message in time.
+var errAckTimeout = errors.New("messenger: message not acknowledged")
+
+// Delivery is a handle to a message given to the Messenger. It is resolved
+// once the message has been acknowledged by Slack or when the Messenger gives
+// up delivering it.
+type Delivery struct {
+	done chan struct{}
+	ts   string
+	err  error
+}
+
+func newDelivery() *Delivery {
+	return &Delivery{done: make(chan struct{})}
+}
+
+// Done returns a channel that is closed when the delivery is resolved.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns the reason why the message could not be delivered or nil if it
+// was delivered. It must not be called before the delivery is resolved.
+func (d *Delivery) Err() error {
+	return d.err
+}
+
+// Timestamp returns the timestamp that Slack gave to the posted message. It
+// must not be called before the delivery is resolved.
+func (d *Delivery) Timestamp() string {
+	return d.ts
+}
+
+// Wait blocks until the delivery is resolved or the context is done and
+// returns the result of the delivery.
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Delivery) resolve(ts string, err error) {
+	d.ts, d.err = ts, err
+	close(d.done)
+}
+
+// A deliveryTracker is implemented by messengers that confirm the delivery of
+// the messages with the acknowledgements sent by Slack. The messages are only
+// posted while the client is connected, the adapter tells the messenger when
+// it connects and disconnects.
+type deliveryTracker interface {
+	ack(id int, ts string, err error)
+	setConnected(connected bool)
+}
+
+// ackResult is the outcome of an attempt to post a message.
+type ackResult struct {
+	ts  string
+	err error
+}
+
+// acks keeps the messages posted that are waiting to be acknowledged, indexed
+// by their message ID.
+type acks struct {
+	pending map[int]chan ackResult
+	mux     sync.Mutex
+}
+
+// expect returns the channel where the acknowledgement of the message will be
+// delivered.
+func (a *acks) expect(id int) <-chan ackResult {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	ch := make(chan ackResult, 1)
+	a.pending[id] = ch
+	return ch
+}
+
+// forget stops waiting for the acknowledgement of the message.
+func (a *acks) forget(id int) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	delete(a.pending, id)
+}
+
+// resolve delivers the acknowledgement of a message, it returns false when
+// nobody was waiting for it.
+func (a *acks) resolve(id int, res ackResult) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	ch, ok := a.pending[id]
+	if !ok {
+		return false
+	}
+	delete(a.pending, id)
+	ch <- res
+	return true
+}
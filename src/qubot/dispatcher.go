@@ -0,0 +1,140 @@
+package qubot
+
+import (
+	"fmt"
+	"hash/fnv"
+	"logger"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Default settings of the dispatcher used when the configuration does not
+// provide them.
+const (
+	dspWorkers      = 4
+	dspQueueSize    = 50
+	dspEventTimeout = 10 * time.Second
+)
+
+// dispatchFunc handles an event. The context is cancelled when the event
+// times out or when the service is shutting down.
+type dispatchFunc func(context.Context, interface{}) error
+
+// dispatcher runs the events received from the adapter in a fixed pool of workers.
+// Each worker has its own queue and the events are assigned to the workers
+// using a key, e.g. the channel ID, so the events that share a key are handled
+// in order while the rest are handled in parallel. When the queue of a worker
+// is full, dispatch blocks until there is room for the event.
+type dispatcher struct {
+	fn      dispatchFunc
+	timeout time.Duration
+	queues  []chan interface{}
+	wg      sync.WaitGroup
+}
+
+// newDispatcher returns a new dispatcher. The default settings are used when
+// config is nil or some of its values are not set.
+func newDispatcher(config *DispatcherConfig, fn dispatchFunc) *dispatcher {
+	workers, size := dspWorkers, dspQueueSize
+	if config != nil {
+		if config.Workers > 0 {
+			workers = config.Workers
+		}
+		if config.QueueSize > 0 {
+			size = config.QueueSize
+		}
+	}
+	d := &dispatcher{
+		fn:      fn,
+		timeout: config.eventTimeout(),
+		queues:  make([]chan interface{}, workers),
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan interface{}, size)
+	}
+	return d
+}
+
+// start launches the workers, they run until the context is done.
+func (d *dispatcher) start(ctx context.Context) {
+	for _, q := range d.queues {
+		d.wg.Add(1)
+		go func(q chan interface{}) {
+			defer d.wg.Done()
+			d.work(ctx, q)
+		}(q)
+	}
+}
+
+// wait blocks until all the workers are done.
+func (d *dispatcher) wait() {
+	d.wg.Wait()
+}
+
+// drain closes the queues and waits until the workers have handled the events
+// left in them. Nothing can be dispatched afterwards.
+func (d *dispatcher) drain() {
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.wg.Wait()
+}
+
+// dispatch puts the event in the queue of the worker that owns the key. It
+// blocks while the queue is full unless the context is done first.
+func (d *dispatcher) dispatch(ctx context.Context, key string, event interface{}) error {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	q := d.queues[h.Sum32()%uint32(len(d.queues))]
+
+	select {
+	case q <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *dispatcher) work(ctx context.Context, q chan interface{}) {
+	for {
+		select {
+		case event, ok := <-q:
+			if !ok {
+				return
+			}
+			d.run(ctx, event)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run handles the event and waits until it is done or it times out. A
+// handler that ignores the cancellation of its context is left behind so the
+// worker can carry on with the next event.
+func (d *dispatcher) run(ctx context.Context, event interface{}) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				logger.Warn("qubot", "dispatcher", "Panic! Regained control.", p)
+				done <- nil
+			}
+		}()
+		done <- d.fn(ctx, event)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			logger.Warn("qubot", "dispatcher", "error", err)
+		}
+	case <-ctx.Done():
+		logger.Warn("qubot", "Event handling timed out", "type", fmt.Sprintf("%T", event), "error", ctx.Err())
+	}
+}
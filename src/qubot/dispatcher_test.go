@@ -0,0 +1,138 @@
+package qubot
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"testutil"
+
+	"github.com/nlopes/slack"
+	"golang.org/x/net/context"
+)
+
+func newTestMessageEvent(channel, text string) *slack.RTMEvent {
+	return &slack.RTMEvent{Type: "message", Data: &slack.MessageEvent{
+		Msg: slack.Msg{Type: "message", Channel: channel, User: "U100", Text: text},
+	}}
+}
+
+// Ensure that the events of a channel are handled in order while different
+// channels are handled in parallel.
+func TestDispatcher_order(t *testing.T) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	got := map[string][]string{}
+	block := make(chan struct{})
+	d := newDispatcher(&DispatcherConfig{Workers: 2}, func(_ context.Context, event interface{}) error {
+		defer wg.Done()
+		e := event.(*slack.RTMEvent).Data.(*slack.MessageEvent)
+		if e.Channel == "C1" {
+			<-block
+		}
+		mu.Lock()
+		got[e.Channel] = append(got[e.Channel], e.Text)
+		mu.Unlock()
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer d.wait()
+	defer cancel()
+	d.start(ctx)
+
+	// C1 and C2 are assigned to different workers.
+	wg.Add(10)
+	for i := 0; i < 5; i++ {
+		testutil.Ok(t, d.dispatch(ctx, "C1", newTestMessageEvent("C1", fmt.Sprint(i))))
+		testutil.Ok(t, d.dispatch(ctx, "C2", newTestMessageEvent("C2", fmt.Sprint(i))))
+	}
+
+	// C2 does not wait for C1.
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		mu.Lock()
+		n := len(got["C2"])
+		mu.Unlock()
+		if n == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("C2 events were not handled")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	close(block)
+	wg.Wait()
+	exp := []string{"0", "1", "2", "3", "4"}
+	testutil.Equals(t, map[string][]string{"C1": exp, "C2": exp}, got)
+}
+
+// Ensure that the handler context is cancelled when the event times out.
+func TestDispatcher_timeout(t *testing.T) {
+	cancelled := make(chan error, 1)
+	d := newDispatcher(&DispatcherConfig{Workers: 1, EventTimeout: "10ms"}, func(ctx context.Context, _ interface{}) error {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer d.wait()
+	defer cancel()
+	d.start(ctx)
+
+	testutil.Ok(t, d.dispatch(ctx, "C1", newTestMessageEvent("C1", "hi")))
+	select {
+	case err := <-cancelled:
+		testutil.Equals(t, context.DeadlineExceeded, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("handler context was not cancelled")
+	}
+}
+
+// Ensure that dispatch blocks when the queue of the worker is full.
+func TestDispatcher_backpressure(t *testing.T) {
+	block := make(chan struct{})
+	d := newDispatcher(&DispatcherConfig{Workers: 1, QueueSize: 1}, func(_ context.Context, _ interface{}) error {
+		<-block
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer d.wait()
+	defer cancel()
+	defer close(block)
+	d.start(ctx)
+
+	// The first event keeps the worker busy and the second fills the queue.
+	testutil.Ok(t, d.dispatch(ctx, "C1", newTestMessageEvent("C1", "1")))
+	time.Sleep(time.Millisecond * 10)
+	testutil.Ok(t, d.dispatch(ctx, "C1", newTestMessageEvent("C1", "2")))
+
+	tctx, tcancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer tcancel()
+	testutil.Equals(t, context.DeadlineExceeded, d.dispatch(tctx, "C1", newTestMessageEvent("C1", "3")))
+}
+
+// Ensure that the events left in the queues are handled when the dispatcher is
+// drained.
+func TestDispatcher_drain(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	d := newDispatcher(&DispatcherConfig{Workers: 2}, func(_ context.Context, event interface{}) error {
+		time.Sleep(time.Millisecond * 10)
+		mu.Lock()
+		got = append(got, event.(*slack.RTMEvent).Data.(*slack.MessageEvent).Text)
+		mu.Unlock()
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.start(ctx)
+
+	for _, text := range []string{"1", "2", "3"} {
+		testutil.Ok(t, d.dispatch(ctx, "C1", newTestMessageEvent("C1", text)))
+	}
+	d.drain()
+	testutil.Equals(t, []string{"1", "2", "3"}, got)
+}
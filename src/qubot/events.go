@@ -0,0 +1,206 @@
+package qubot
+
+import (
+	"golang.org/x/net/context"
+)
+
+// EventKind identifies a kind of event.
+type EventKind string
+
+// These are the kinds of event that handlers can subscribe to.
+const (
+	ReactionAdded   EventKind = "reaction_added"
+	ReactionRemoved EventKind = "reaction_removed"
+	PresenceChanged EventKind = "presence_change"
+	MemberJoined    EventKind = "member_joined"
+	MemberLeft      EventKind = "member_left"
+	FileShared      EventKind = "file_shared"
+	PinAdded        EventKind = "pin_added"
+	PinRemoved      EventKind = "pin_removed"
+
+	ConnectionChanged EventKind = "connection_change"
+)
+
+// Event is an event received from the chat service other than a message.
+type Event interface {
+	Kind() EventKind
+}
+
+// An EventHandler is implemented by handlers that want to receive events
+// other than messages. Events returns the kinds of event that the handler
+// subscribes to, it is called once when the handler is registered.
+//
+// The response given to HandleEvent replies in the channel where the event
+// happened or, when there is no channel, to the user that caused it.
+type EventHandler interface {
+	Events() []EventKind
+	HandleEvent(context.Context, Response, Event)
+}
+
+// ReactionEvent is sent when a user adds or removes a reaction to a message.
+type ReactionEvent struct {
+	Added    bool
+	User     *User
+	Reaction string
+	Channel  *Channel
+	// Timestamp is the timestamp of the message that the reaction belongs
+	// to, ItemUser is the author of the message.
+	Timestamp string
+	ItemUser  *User
+}
+
+// Kind implements the Event interface.
+func (e *ReactionEvent) Kind() EventKind {
+	if e.Added {
+		return ReactionAdded
+	}
+	return ReactionRemoved
+}
+
+// PresenceEvent is sent when a user goes "active" or "away".
+type PresenceEvent struct {
+	User     *User
+	Presence string
+}
+
+// Kind implements the Event interface.
+func (e *PresenceEvent) Kind() EventKind { return PresenceChanged }
+
+// MemberEvent is sent when a user joins or leaves a channel.
+type MemberEvent struct {
+	Joined  bool
+	User    *User
+	Channel *Channel
+}
+
+// Kind implements the Event interface.
+func (e *MemberEvent) Kind() EventKind {
+	if e.Joined {
+		return MemberJoined
+	}
+	return MemberLeft
+}
+
+// FileEvent is sent when a file is shared.
+type FileEvent struct {
+	ID    string
+	Name  string
+	Title string
+	User  *User
+}
+
+// Kind implements the Event interface.
+func (e *FileEvent) Kind() EventKind { return FileShared }
+
+// PinEvent is sent when a message is pinned to or unpinned from a channel.
+type PinEvent struct {
+	Added     bool
+	User      *User
+	Channel   *Channel
+	Timestamp string
+}
+
+// Kind implements the Event interface.
+func (e *PinEvent) Kind() EventKind {
+	if e.Added {
+		return PinAdded
+	}
+	return PinRemoved
+}
+
+// ConnectionState is the state of the connection with the chat service.
+type ConnectionState int
+
+// These are the states of the connection.
+const (
+	// ConnectionConnecting means that the adapter is trying to connect.
+	ConnectionConnecting ConnectionState = iota
+	// ConnectionConnected means that the adapter is connected, the
+	// directory of users and channels has been synchronized.
+	ConnectionConnected
+	// ConnectionDisconnected means that the connection has been lost, the
+	// adapter reconnects on its own.
+	ConnectionDisconnected
+	// ConnectionFailed means that the adapter gave up, e.g. because its
+	// credentials were rejected. Qubot shuts down.
+	ConnectionFailed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionConnecting:
+		return "connecting"
+	case ConnectionConnected:
+		return "connected"
+	case ConnectionDisconnected:
+		return "disconnected"
+	case ConnectionFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// ConnectionEvent is sent when the state of the connection with the chat
+// service changes. Err is the reason of the change, when it is known.
+type ConnectionEvent struct {
+	State ConnectionState
+	Err   error
+}
+
+// Kind implements the Event interface.
+func (e *ConnectionEvent) Kind() EventKind { return ConnectionChanged }
+
+// eventSource returns the user that caused the event and the channel where it
+// happened, the latter can be nil.
+func eventSource(event Event) (*User, *Channel) {
+	switch e := event.(type) {
+	case *ReactionEvent:
+		return e.User, e.Channel
+	case *PresenceEvent:
+		return e.User, nil
+	case *MemberEvent:
+		return e.User, e.Channel
+	case *FileEvent:
+		return e.User, nil
+	case *PinEvent:
+		return e.User, e.Channel
+	}
+	return nil, nil
+}
+
+// onEvent passes the event to the handlers that subscribed to its kind. The
+// events caused by the bot itself and by ignored users are dropped.
+func (q *Qubot) onEvent(ctx context.Context, event Event) error {
+	user, channel := eventSource(event)
+	if user != nil && user.ID != "" {
+		me := q.a.Me()
+		if (me != nil && me.ID == user.ID) || q.config.Filters.ignoreUser(user.ID, user.Name) {
+			return nil
+		}
+	}
+
+	// Reply in the channel of the event, or to the user when there is none.
+	// The replies to events with neither fail, see errNoChannel.
+	var to, from string
+	if user != nil {
+		to, from = user.ID, user.ID
+	}
+	if channel != nil && channel.ID != "" {
+		to = channel.ID
+	}
+
+	q.hmux.RLock()
+	handlers := make([]*supervisedHandler, len(q.handlers))
+	copy(handlers, q.handlers)
+	q.hmux.RUnlock()
+
+	for _, sh := range handlers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if sh.subscribed(event.Kind()) {
+			sh.handleEvent(ctx, newResponse(q.a, to, from, "", ""), event)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package qubot
+
+import (
+	"testing"
+	"time"
+
+	"testutil"
+
+	"github.com/nlopes/slack"
+	"golang.org/x/net/context"
+)
+
+// eventTestHandler implements the Handler and EventHandler interfaces, it
+// subscribes to reactions and members joining channels, and welcomes them.
+type eventTestHandler struct {
+	events chan Event
+}
+
+func (h *eventTestHandler) Start(ctx context.Context) error { return nil }
+
+func (h *eventTestHandler) Handle(ctx context.Context, r Response, msg *Message) {}
+
+func (h *eventTestHandler) Events() []EventKind {
+	return []EventKind{ReactionAdded, MemberJoined}
+}
+
+func (h *eventTestHandler) HandleEvent(ctx context.Context, r Response, e Event) {
+	if m, ok := e.(*MemberEvent); ok {
+		r.Replyf("Welcome, %s!", m.User.Name)
+	}
+	h.events <- e
+}
+
+// Ensure that handlers get the kinds of event they subscribed to.
+func TestQubot_events(t *testing.T) {
+	q := InitTestQubot()
+	rtm := testRTM(q)
+	rtm.info = testInfo()
+	h := &eventTestHandler{events: make(chan Event, 10)}
+	q.Handle(h)
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	reaction := func(user string) *slack.ReactionAddedEvent {
+		e := &slack.ReactionAddedEvent{User: user, Reaction: "+1"}
+		e.Item.Channel, e.Item.Timestamp = "C100", "1000.01"
+		return e
+	}
+	rtm.events <- slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{}}
+	rtm.events <- slack.RTMEvent{Type: "reaction_added", Data: reaction("U001")}
+	rtm.events <- slack.RTMEvent{Type: "presence_change", Data: &slack.PresenceChangeEvent{User: "U100", Presence: "away"}}
+	rtm.events <- slack.RTMEvent{Type: "reaction_added", Data: reaction("U100")}
+	rtm.events <- slack.RTMEvent{Type: "message", Data: &slack.MessageEvent{Msg: slack.Msg{Channel: "C200", SubType: "channel_join", User: "U200"}}}
+
+	var events []Event
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-h.events:
+			events = append(events, e)
+		case <-time.After(time.Second * 5):
+			t.Fatal("event not handled")
+		}
+	}
+	if events[0].Kind() != ReactionAdded {
+		events[0], events[1] = events[1], events[0]
+	}
+
+	r := events[0].(*ReactionEvent)
+	testutil.Equals(t, "alice", r.User.Name)
+	testutil.Equals(t, "general", r.Channel.Name)
+	testutil.Equals(t, "1000.01", r.Timestamp)
+	m := events[1].(*MemberEvent)
+	testutil.Equals(t, MemberJoined, m.Kind())
+	testutil.Equals(t, "random", m.Channel.Name)
+
+	select {
+	case msg := <-rtm.sent:
+		testutil.Equals(t, "C200", msg.Channel)
+		testutil.Equals(t, "Welcome, bob!", msg.Text)
+	case <-time.After(time.Second * 5):
+		t.Fatal("welcome not sent")
+	}
+	testutil.Equals(t, 0, len(h.events))
+}
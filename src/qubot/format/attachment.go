@@ -0,0 +1,97 @@
+package format
+
+import (
+	"strings"
+
+	"qubot"
+)
+
+// Colors understood by Slack for the border of an attachment, any hex color
+// like "#439FE0" works too.
+const (
+	ColorGood    = "good"
+	ColorWarning = "warning"
+	ColorDanger  = "danger"
+)
+
+// AttachmentBuilder builds a qubot.Attachment. The title, the author, the
+// footer, the fallback and the titles of the fields are plain text, the text,
+// the pretext and the values of the fields are markup.
+type AttachmentBuilder struct {
+	a qubot.Attachment
+}
+
+// NewAttachment returns a builder of an attachment with the title given.
+func NewAttachment(title string) *AttachmentBuilder {
+	return &AttachmentBuilder{a: qubot.Attachment{
+		Title:      Escape(title),
+		MarkdownIn: []string{"text", "pretext", "fields"},
+	}}
+}
+
+// TitleLink makes the title a link to the URL.
+func (b *AttachmentBuilder) TitleLink(url string) *AttachmentBuilder {
+	b.a.TitleLink = url
+	return b
+}
+
+// Text sets the text of the attachment.
+func (b *AttachmentBuilder) Text(markup string) *AttachmentBuilder {
+	b.a.Text = markup
+	return b
+}
+
+// Pretext sets the text shown above the attachment.
+func (b *AttachmentBuilder) Pretext(markup string) *AttachmentBuilder {
+	b.a.Pretext = markup
+	return b
+}
+
+// Color sets the color of the border, see ColorGood.
+func (b *AttachmentBuilder) Color(color string) *AttachmentBuilder {
+	b.a.Color = color
+	return b
+}
+
+// Author sets the author of the attachment, it is a link when url is not
+// empty.
+func (b *AttachmentBuilder) Author(name, url string) *AttachmentBuilder {
+	b.a.AuthorName, b.a.AuthorLink = Escape(name), url
+	return b
+}
+
+// Field adds a field, short fields are laid out side by side.
+func (b *AttachmentBuilder) Field(title, markup string, short bool) *AttachmentBuilder {
+	b.a.Fields = append(b.a.Fields, qubot.AttachmentField{Title: Escape(title), Value: markup, Short: short})
+	return b
+}
+
+// Footer sets the small text shown below the attachment.
+func (b *AttachmentBuilder) Footer(text string) *AttachmentBuilder {
+	b.a.Footer = Escape(text)
+	return b
+}
+
+// Fallback sets the plain text summary shown where the attachment can not be
+// displayed, e.g. in notifications.
+func (b *AttachmentBuilder) Fallback(text string) *AttachmentBuilder {
+	b.a.Fallback = Escape(text)
+	return b
+}
+
+// Build returns the attachment. When no fallback has been given, it is made
+// of the title and the text without their markup.
+func (b *AttachmentBuilder) Build() qubot.Attachment {
+	a := b.a
+	a.Fields = append([]qubot.AttachmentField(nil), b.a.Fields...)
+	if a.Fallback == "" {
+		var parts []string
+		for _, s := range []string{a.Title, a.Text} {
+			if s != "" {
+				parts = append(parts, Plain(s))
+			}
+		}
+		a.Fallback = Escape(strings.Join(parts, ": "))
+	}
+	return a
+}
@@ -0,0 +1,39 @@
+package format_test
+
+import (
+	"fmt"
+
+	"qubot"
+	"qubot/format"
+	"redmine"
+)
+
+// Render a Redmine issue as the card of a message.
+func ExampleNewAttachment() {
+	number, subject := 42, "Login fails with <script> in the password"
+	issue := redmine.Issue{Number: &number, Subject: &subject}
+
+	card := format.NewAttachment(fmt.Sprintf("#%d %s", *issue.Number, *issue.Subject)).
+		TitleLink(fmt.Sprintf("https://redmine.example.com/issues/%d", *issue.Number)).
+		Color(format.ColorDanger).
+		Field("Status", format.Bold("New"), true).
+		Field("Assignee", format.User("U123"), true).
+		Build()
+	msg := &qubot.OutgoingMessage{
+		Text:        "Issue created by " + format.User("U200"),
+		Attachments: []qubot.Attachment{card},
+	}
+
+	fmt.Println(msg.Text)
+	fmt.Println(card.Title)
+	fmt.Println(card.Fallback)
+	for _, f := range card.Fields {
+		fmt.Printf("%s: %s\n", f.Title, f.Value)
+	}
+	// Output:
+	// Issue created by <@U200>
+	// #42 Login fails with &lt;script&gt; in the password
+	// #42 Login fails with &lt;script&gt; in the password
+	// Status: *New*
+	// Assignee: <@U123>
+}
@@ -0,0 +1,164 @@
+// Package format builds and parses the markup of Slack messages, see
+// https://api.slack.com/docs/message-formatting.
+//
+// The functions that take plain text escape it, the ones that take markup,
+// e.g. List, do not. Parse does the opposite and turns the markup of the
+// messages received into tokens.
+package format
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Special mentions that notify the members of a channel.
+const (
+	Here     = "<!here>"
+	Everyone = "<!everyone>"
+	// ChannelMembers notifies every member of the channel, online or not.
+	ChannelMembers = "<!channel>"
+)
+
+// Bullet starts the items of a list.
+const Bullet = "•"
+
+var (
+	escaper   = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	unescaper = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+)
+
+// Escape escapes the characters that Slack uses for its markup: &, < and >.
+func Escape(text string) string {
+	return escaper.Replace(text)
+}
+
+// Unescape reverses Escape.
+func Unescape(text string) string {
+	return unescaper.Replace(text)
+}
+
+// User mentions the user with the ID given.
+func User(id string) string {
+	return "<@" + id + ">"
+}
+
+// Channel links the channel with the ID given, Slack shows its name.
+func Channel(id string) string {
+	return "<#" + id + ">"
+}
+
+// Link links the URL with the label given, the URL is shown when the label is
+// empty.
+func Link(url, label string) string {
+	if label == "" {
+		return "<" + Escape(url) + ">"
+	}
+	return "<" + Escape(url) + "|" + Escape(label) + ">"
+}
+
+// Bold returns the text in bold.
+func Bold(text string) string {
+	return wrap("*", text)
+}
+
+// Italic returns the text in italics.
+func Italic(text string) string {
+	return wrap("_", text)
+}
+
+// Strike returns the text struck through.
+func Strike(text string) string {
+	return wrap("~", text)
+}
+
+// Code returns the text in a fixed-width font.
+func Code(text string) string {
+	return wrap("`", text)
+}
+
+// wrap puts the marker around the text. Slack ignores the markers that are
+// next to a space so the spaces around the text are left outside.
+func wrap(marker, text string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return Escape(text)
+	}
+	i := strings.Index(text, trimmed)
+	return Escape(text[:i]) + marker + Escape(trimmed) + marker + Escape(text[i+len(trimmed):])
+}
+
+// CodeBlock returns the text in a block of fixed-width text.
+func CodeBlock(text string) string {
+	return "```\n" + Escape(strings.TrimRight(text, "\n")) + "\n```"
+}
+
+// List returns a bulleted list of the items, one per line. The items are
+// markup, e.g. they can contain links.
+func List(items ...string) string {
+	lines := make([]string, len(items))
+	for i, item := range items {
+		lines[i] = Bullet + " " + item
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Table is a table rendered as a code block with its columns aligned. The
+// cells are plain text.
+type Table struct {
+	header []string
+	rows   [][]string
+}
+
+// NewTable returns a new table with the header given, it can be empty.
+func NewTable(header ...string) *Table {
+	return &Table{header: header}
+}
+
+// Row adds a row to the table.
+func (t *Table) Row(cells ...string) *Table {
+	t.rows = append(t.rows, cells)
+	return t
+}
+
+// String renders the table. The header is underlined and the columns are
+// separated by two spaces.
+func (t *Table) String() string {
+	var widths []int
+	measure := func(cells []string) {
+		for i, c := range cells {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := utf8.RuneCountInString(c); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	measure(t.header)
+	for _, row := range t.rows {
+		measure(row)
+	}
+
+	var lines []string
+	if len(t.header) > 0 {
+		lines = append(lines, t.line(t.header, widths))
+		rule := make([]string, len(t.header))
+		for i := range rule {
+			rule[i] = strings.Repeat("-", widths[i])
+		}
+		lines = append(lines, t.line(rule, widths))
+	}
+	for _, row := range t.rows {
+		lines = append(lines, t.line(row, widths))
+	}
+	return CodeBlock(strings.Join(lines, "\n"))
+}
+
+// line pads the cells to the width of their columns.
+func (t *Table) line(cells []string, widths []int) string {
+	padded := make([]string, len(cells))
+	for i, c := range cells {
+		padded[i] = c + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(c))
+	}
+	return strings.TrimRight(strings.Join(padded, "  "), " ")
+}
@@ -0,0 +1,51 @@
+package format
+
+import (
+	"testing"
+
+	"testutil"
+)
+
+// Ensure that the builders escape the text they are given.
+func TestBuilders(t *testing.T) {
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{Escape("a < b && b > c"), "a &lt; b &amp;&amp; b &gt; c"},
+		{Unescape("a &lt; b &amp;&amp; b &gt; c"), "a < b && b > c"},
+		{User("U123"), "<@U123>"},
+		{Channel("C123"), "<#C123>"},
+		{Link("http://example.com/?a=1&b=2", ""), "<http://example.com/?a=1&amp;b=2>"},
+		{Link("http://example.com", "R&D <team>"), "<http://example.com|R&amp;D &lt;team&gt;>"},
+		{Bold("fix"), "*fix*"},
+		{Bold(" fix it "), " *fix it* "},
+		{Bold("  "), "  "},
+		{Italic("a<b"), "_a&lt;b_"},
+		{Strike("old"), "~old~"},
+		{Code("x := <-ch"), "`x := &lt;-ch`"},
+		{CodeBlock("if a && b {\n}\n"), "```\nif a &amp;&amp; b {\n}\n```"},
+		{List(Bold("one"), Link("http://example.com", "two")), "• *one*\n• <http://example.com|two>"},
+		{List(), ""},
+	}
+	for _, tt := range tests {
+		testutil.Equals(t, tt.want, tt.got)
+	}
+}
+
+// Ensure that the columns of a table are aligned.
+func TestTable(t *testing.T) {
+	table := NewTable("Issue", "Status", "Subject").
+		Row("#1", "New", "Crash on start").
+		Row("#1234", "Resolved", "Ñandú <sic>").
+		Row("#7")
+	testutil.Equals(t, "```\n"+
+		"Issue  Status    Subject\n"+
+		"-----  --------  --------------\n"+
+		"#1     New       Crash on start\n"+
+		"#1234  Resolved  Ñandú &lt;sic&gt;\n"+
+		"#7\n"+
+		"```", table.String())
+
+	testutil.Equals(t, "```\na  b\n```", NewTable().Row("a", "b").String())
+}
@@ -0,0 +1,175 @@
+package format
+
+import (
+	"strings"
+)
+
+// TokenKind is the kind of a token of the markup.
+type TokenKind int
+
+// These are the kinds of token.
+const (
+	// TextToken is plain text.
+	TextToken TokenKind = iota
+	// UserToken is a mention of a user, <@U123> or <@U123|bob>.
+	UserToken
+	// ChannelToken is a link to a channel, <#C123> or <#C123|general>.
+	ChannelToken
+	// LinkToken is a link, <http://example.com> or
+	// <http://example.com|example>. Email addresses are links too.
+	LinkToken
+	// CommandToken is a special mention, e.g. <!here>, or a user group,
+	// <!subteam^S123|@team>.
+	CommandToken
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TextToken:
+		return "text"
+	case UserToken:
+		return "user"
+	case ChannelToken:
+		return "channel"
+	case LinkToken:
+		return "link"
+	case CommandToken:
+		return "command"
+	}
+	return "unknown"
+}
+
+// Token is a piece of the markup of a message.
+type Token struct {
+	Kind TokenKind
+	// Text is the unescaped text of a TextToken.
+	Text string
+	// ID is the ID of the user or the channel, the URL of the link or the
+	// name of the command, e.g. "here" or "subteam^S123".
+	ID string
+	// Label is the text shown by Slack when it is given in the markup, it
+	// is unescaped.
+	Label string
+}
+
+// String returns the text shown by Slack for the token. Mentions without a
+// label are shown by their ID.
+func (t Token) String() string {
+	switch t.Kind {
+	case TextToken:
+		return t.Text
+	case UserToken:
+		return "@" + t.label()
+	case ChannelToken:
+		return "#" + t.label()
+	case CommandToken:
+		if t.Label != "" {
+			return t.Label
+		}
+		return "@" + t.ID
+	}
+	return t.label()
+}
+
+func (t Token) label() string {
+	if t.Label != "" {
+		return t.Label
+	}
+	return t.ID
+}
+
+// Parse splits the markup of a message in tokens. The text is unescaped and
+// the pieces of markup that can not be parsed are kept as text.
+func Parse(markup string) []Token {
+	var tokens []Token
+	text := func(s string) {
+		if s == "" {
+			return
+		}
+		if n := len(tokens); n > 0 && tokens[n-1].Kind == TextToken {
+			tokens[n-1].Text += Unescape(s)
+			return
+		}
+		tokens = append(tokens, Token{Kind: TextToken, Text: Unescape(s)})
+	}
+
+	for markup != "" {
+		i := strings.Index(markup, "<")
+		if i < 0 {
+			text(markup)
+			break
+		}
+		j := strings.Index(markup[i:], ">")
+		if j < 0 {
+			text(markup)
+			break
+		}
+		text(markup[:i])
+		if t, ok := parseToken(markup[i+1 : i+j]); ok {
+			tokens = append(tokens, t)
+		} else {
+			text(markup[i : i+j+1])
+		}
+		markup = markup[i+j+1:]
+	}
+	return tokens
+}
+
+// parseToken parses the contents of a piece of markup, between < and >.
+func parseToken(s string) (Token, bool) {
+	var t Token
+	if s == "" {
+		return t, false
+	}
+	id, label := s, ""
+	if i := strings.Index(s, "|"); i >= 0 {
+		id, label = s[:i], Unescape(s[i+1:])
+	}
+	t.Label = label
+	switch id[0] {
+	case '@':
+		t.Kind, t.ID = UserToken, id[1:]
+	case '#':
+		t.Kind, t.ID = ChannelToken, id[1:]
+	case '!':
+		t.Kind, t.ID = CommandToken, id[1:]
+	default:
+		t.Kind, t.ID = LinkToken, Unescape(id)
+	}
+	return t, t.ID != ""
+}
+
+// Plain returns the text shown by Slack for the markup, without the markup of
+// the mentions and links. See Token.String.
+func Plain(markup string) string {
+	var parts []string
+	for _, t := range Parse(markup) {
+		parts = append(parts, t.String())
+	}
+	return strings.Join(parts, "")
+}
+
+// Mentions returns the IDs of the users mentioned in the markup, in order and
+// without duplicates.
+func Mentions(markup string) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, t := range Parse(markup) {
+		if t.Kind == UserToken && !seen[t.ID] {
+			seen[t.ID] = true
+			ids = append(ids, t.ID)
+		}
+	}
+	return ids
+}
+
+// Links returns the links found in the markup.
+func Links(markup string) []Token {
+	var links []Token
+	for _, t := range Parse(markup) {
+		if t.Kind == LinkToken {
+			links = append(links, t)
+		}
+	}
+	return links
+}
@@ -0,0 +1,60 @@
+package format
+
+import (
+	"testing"
+
+	"testutil"
+)
+
+// Ensure that the mentions and links of a message are turned into tokens and
+// that the text is unescaped.
+func TestParse(t *testing.T) {
+	tokens := Parse("<@U123|bob>: see <http://example.com/?a=1&amp;b=2|R&amp;D> in <#C123|dev>, <!here> &lt;3")
+	testutil.Equals(t, []Token{
+		{Kind: UserToken, ID: "U123", Label: "bob"},
+		{Kind: TextToken, Text: ": see "},
+		{Kind: LinkToken, ID: "http://example.com/?a=1&b=2", Label: "R&D"},
+		{Kind: TextToken, Text: " in "},
+		{Kind: ChannelToken, ID: "C123", Label: "dev"},
+		{Kind: TextToken, Text: ", "},
+		{Kind: CommandToken, ID: "here"},
+		{Kind: TextToken, Text: " <3"},
+	}, tokens)
+
+	// Broken markup is kept as text.
+	testutil.Equals(t, []Token{{Kind: TextToken, Text: "a <> b <@ c < d"}}, Parse("a <> b <@ c &lt; d"))
+	testutil.Equals(t, []Token{{Kind: TextToken, Text: "<@|bob> x"}}, Parse("<@|bob> x"))
+	testutil.Equals(t, []Token(nil), Parse(""))
+}
+
+// Ensure that the markup is turned into the text shown by Slack.
+func TestPlain(t *testing.T) {
+	tests := []struct {
+		markup string
+		plain  string
+	}{
+		{"hi <@U123|bob>", "hi @bob"},
+		{"hi <@U123>", "hi @U123"},
+		{"<#C123|dev> <#C200>", "#dev #C200"},
+		{"<http://example.com>", "http://example.com"},
+		{"<mailto:bob@example.com|bob@example.com>", "bob@example.com"},
+		{"<!channel> <!subteam^S123|@ops>", "@channel @ops"},
+		{"a &amp; b", "a & b"},
+	}
+	for _, tt := range tests {
+		testutil.Equals(t, tt.plain, Plain(tt.markup))
+	}
+}
+
+// Ensure that the users mentioned and the links are found.
+func TestMentionsAndLinks(t *testing.T) {
+	markup := "<@U1> <@U2|bob> <@U1> see " + Link("http://example.com", "docs") + " and <http://example.org>"
+	testutil.Equals(t, []string{"U1", "U2"}, Mentions(markup))
+	testutil.Equals(t, []Token{
+		{Kind: LinkToken, ID: "http://example.com", Label: "docs"},
+		{Kind: LinkToken, ID: "http://example.org"},
+	}, Links(markup))
+
+	// The builders and the parser agree.
+	testutil.Equals(t, []Token{{Kind: UserToken, ID: "U9"}}, Parse(User("U9")))
+}
@@ -10,12 +10,75 @@ import (
 // is expected to return when a cancellation signal is emitted via the context
 // object. The implementor is signaled via the channel returned by
 // context.Done().
+//
+// The context given to Handle is cancelled when the message times out or when
+// Qubot is shutting down. Handlers that do network calls should give up when
+// this happens.
 type Handler interface {
 	Start(context.Context) error
-	Handle(Response, *Message)
+	Handle(context.Context, Response, *Message)
 }
 
 // A HandlerMatcher is implemented by handlers that want to avoid.
 type HandlerMatcher interface {
 	Match(Response, *Message) bool
 }
+
+// An AddressedHandler is implemented by handlers that choose whether they
+// want all the messages or only the ones addressed to the bot, see
+// Message.Addressed. Handlers that do not implement it get all the messages.
+type AddressedHandler interface {
+	AddressedOnly() bool
+}
+
+// LegacyHandler is the interface of the handlers written before Handle was
+// given a context. Use AdaptHandler to register them with Qubot.
+type LegacyHandler interface {
+	Start(context.Context) error
+	Handle(Response, *Message)
+}
+
+// AdaptHandler returns a Handler that calls the Handle method of a
+// LegacyHandler, ignoring the context. If the legacy handler implements
+// HandlerMatcher, so does the handler returned.
+func AdaptHandler(h LegacyHandler) Handler {
+	return &legacyHandler{h}
+}
+
+type legacyHandler struct {
+	LegacyHandler
+}
+
+func (h *legacyHandler) Handle(_ context.Context, r Response, msg *Message) {
+	h.LegacyHandler.Handle(r, msg)
+}
+
+func (h *legacyHandler) Match(r Response, msg *Message) bool {
+	if m, ok := h.LegacyHandler.(HandlerMatcher); ok {
+		return m.Match(r, msg)
+	}
+	return true
+}
+
+func (h *legacyHandler) AddressedOnly() bool {
+	if a, ok := h.LegacyHandler.(AddressedHandler); ok {
+		return a.AddressedOnly()
+	}
+	return false
+}
+
+type contextKey int
+
+const requestIDKey contextKey = 0
+
+// withRequestID returns a copy of the context that carries the request ID.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the ID that Qubot gave to the event being handled, it can
+// be used to correlate the log entries of the different handlers.
+func RequestID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey).(string)
+	return id, ok
+}
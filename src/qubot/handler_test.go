@@ -1,6 +1,13 @@
 package qubot
 
-import "golang.org/x/net/context"
+import (
+	"testing"
+	"time"
+
+	"testutil"
+
+	"golang.org/x/net/context"
+)
 
 // testHandler implements the Handler interface.
 type testHandler struct {
@@ -17,8 +24,86 @@ func (h *testHandler) Start(ctx context.Context) error {
 	}
 }
 
-func (h *testHandler) Handle(r Response, msg *Message) {}
+func (h *testHandler) Handle(ctx context.Context, r Response, msg *Message) {}
 
 func (h *testHandler) Stop() {
 	close(h.done)
 }
+
+// legacyTestHandler implements the LegacyHandler and HandlerMatcher
+// interfaces.
+type legacyTestHandler struct {
+	handled []string
+}
+
+func (h *legacyTestHandler) Start(ctx context.Context) error { return nil }
+
+func (h *legacyTestHandler) Handle(r Response, msg *Message) {
+	h.handled = append(h.handled, msg.RawText)
+}
+
+func (h *legacyTestHandler) Match(r Response, msg *Message) bool {
+	return msg.RawText != "skip"
+}
+
+// Ensure that legacy handlers can be adapted.
+func TestAdaptHandler(t *testing.T) {
+	lh := &legacyTestHandler{}
+	h := AdaptHandler(lh)
+	m, ok := h.(HandlerMatcher)
+	testutil.Assert(t, ok, "adapted handler should implement HandlerMatcher")
+
+	res := NewResponse(&fakeMessenger{}, newTestMessage(""))
+	testutil.Assert(t, !m.Match(res, newTestMessage("skip")), "message should not match")
+	testutil.Assert(t, m.Match(res, newTestMessage("hi")), "message should match")
+	h.Handle(context.Background(), res, newTestMessage("hi"))
+	testutil.Equals(t, []string{"hi"}, lh.handled)
+}
+
+// ctxHandler implements the Handler interface and keeps the contexts given
+// to Handle.
+type ctxHandler struct {
+	ctxs chan context.Context
+}
+
+func (h *ctxHandler) Start(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (h *ctxHandler) Handle(ctx context.Context, r Response, msg *Message) {
+	h.ctxs <- ctx
+}
+
+// Ensure that handlers get a context with a request ID and a deadline that is
+// cancelled when Qubot is closed.
+func TestQubot_handlerContext(t *testing.T) {
+	q := InitTestQubot()
+	h := &ctxHandler{ctxs: make(chan context.Context, 2)}
+	q.Handle(h)
+	testutil.Ok(t, q.Start())
+
+	rtm := testRTM(q)
+	rtm.events <- *newTestMessageEvent("C100", "one")
+	rtm.events <- *newTestMessageEvent("C100", "two")
+
+	var ctxs []context.Context
+	for i := 0; i < 2; i++ {
+		select {
+		case ctx := <-h.ctxs:
+			ctxs = append(ctxs, ctx)
+		case <-time.After(time.Second * 5):
+			t.Fatal("message not handled")
+		}
+	}
+
+	id1, ok := RequestID(ctxs[0])
+	testutil.Assert(t, ok, "request ID should be set")
+	id2, _ := RequestID(ctxs[1])
+	testutil.Assert(t, id1 != id2, "request IDs should be different")
+	_, ok = ctxs[0].Deadline()
+	testutil.Assert(t, ok, "context should have a deadline")
+
+	q.Close()
+	testutil.Assert(t, ctxs[1].Err() != nil, "context should be cancelled")
+}
@@ -1,13 +1,173 @@
 package qubot
 
-import "github.com/nlopes/slack"
+import (
+	"strings"
+)
 
-// A Message represents a message received from Slack.
+// ChannelType is the type of a channel.
+type ChannelType int
+
+// These are the types of channel.
+const (
+	// PublicChannel channels are open to every member of the team.
+	PublicChannel ChannelType = iota
+	// PrivateChannel channels, a.k.a. groups, are invite only.
+	PrivateChannel
+	// DirectChannel channels are direct messages between two users.
+	DirectChannel
+)
+
+func (t ChannelType) String() string {
+	switch t {
+	case PublicChannel:
+		return "public"
+	case PrivateChannel:
+		return "private"
+	case DirectChannel:
+		return "direct"
+	}
+	return "unknown"
+}
+
+// channelType guesses the type of a channel from its ID.
+func channelType(id string) ChannelType {
+	switch {
+	case isIMChannel(id):
+		return DirectChannel
+	case strings.HasPrefix(id, "G"):
+		return PrivateChannel
+	}
+	return PublicChannel
+}
+
+// Attachment is a piece of rich content attached to a message, see
+// https://api.slack.com/docs/message-attachments. The tags give the names
+// used by Slack.
+type Attachment struct {
+	Title      string            `json:"title,omitempty"`
+	TitleLink  string            `json:"title_link,omitempty"`
+	Pretext    string            `json:"pretext,omitempty"`
+	Text       string            `json:"text,omitempty"`
+	Fallback   string            `json:"fallback"`
+	Color      string            `json:"color,omitempty"`
+	Fields     []AttachmentField `json:"fields,omitempty"`
+	AuthorName string            `json:"author_name,omitempty"`
+	AuthorLink string            `json:"author_link,omitempty"`
+	ImageURL   string            `json:"image_url,omitempty"`
+	ThumbURL   string            `json:"thumb_url,omitempty"`
+	Footer     string            `json:"footer,omitempty"`
+	MarkdownIn []string          `json:"mrkdwn_in,omitempty"`
+}
+
+// AttachmentField is a field of an attachment, usually rendered as a table.
+type AttachmentField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// A Message represents a message received from the chat service.
 type Message struct {
-	Msg *slack.Msg
+	// Timestamp identifies the message within its channel.
+	Timestamp string
+	// ThreadTimestamp is the timestamp of the parent message when the
+	// message was sent in a thread.
+	ThreadTimestamp string
+	// User is the sender of the message. Only its ID is guaranteed to be
+	// set, the rest of fields are filled in when the user is known.
+	User *User
+	// Channel is the channel where the message was sent. Only its ID and
+	// type are guaranteed to be set, the rest of fields are filled in when
+	// the channel is known.
+	Channel *Channel
+	// Edited is true when the message is the new version of a message
+	// that was edited, Deleted when the message was deleted.
+	Edited  bool
+	Deleted bool
+	// Attachments of the message.
+	Attachments []Attachment
+	// IsBot is true when the message was posted by an integration, BotID
+	// and BotName identify it when it is known.
+	IsBot   bool
+	BotID   string
+	BotName string
+
+	// IsDirect is true when the message was sent in a direct message
+	// channel with the bot.
+	IsDirect bool
+	// IsMention is true when the bot is mentioned in the message, e.g.
+	// "<@U123> ping".
+	IsMention bool
+	// IsPrefixed is true when the message starts with the nickname of the
+	// bot, e.g. "qubot: ping".
+	IsPrefixed bool
+	// RawText is the text of the message as it was received.
+	RawText string
+	// Text is the text of the message without the leading mention or
+	// nickname.
+	Text string
+}
+
+// copy returns a copy of the message that can be modified without affecting
+// the original.
+func (m *Message) copy() *Message {
+	c := *m
+	user, channel := *m.User, *m.Channel
+	channel.Members = append([]string(nil), channel.Members...)
+	c.User, c.Channel = &user, &channel
+	c.Attachments = append([]Attachment(nil), m.Attachments...)
+	return &c
+}
+
+// Addressed returns true if the message is meant for the bot, i.e. it was
+// sent in a direct message channel, it mentions the bot or it starts with its
+// nickname.
+func (m *Message) Addressed() bool {
+	return m.IsDirect || m.IsMention || m.IsPrefixed
+}
+
+// address finds out whether the message is addressed to the bot, identified
+// by its user ID and nickname, and strips the address from the text.
+func (m *Message) address(id, nickname string) {
+	text := strings.TrimSpace(m.RawText)
+	if id != "" {
+		mention := "<@" + id
+		if rest, ok := trimAddress(text, mention+">"); ok {
+			m.IsMention, text = true, rest
+		} else if strings.HasPrefix(text, mention+"|") {
+			if i := strings.Index(text, ">"); i > 0 {
+				m.IsMention, text = true, trimSeparator(text[i+1:])
+			}
+		} else if strings.Contains(text, mention+">") || strings.Contains(text, mention+"|") {
+			m.IsMention = true
+		}
+	}
+	if !m.IsMention && nickname != "" {
+		for _, prefix := range []string{nickname + ":", nickname + ",", "@" + nickname} {
+			if rest, ok := trimAddress(text, prefix); ok {
+				m.IsPrefixed, text = true, rest
+				break
+			}
+		}
+	}
+	m.Text = text
+}
+
+// trimAddress removes the prefix from the text, ignoring case. A prefix that
+// ends with a word character must be followed by a separator, so "@qubots"
+// does not address "@qubot".
+func trimAddress(text, prefix string) (string, bool) {
+	if len(text) < len(prefix) || !strings.EqualFold(text[:len(prefix)], prefix) {
+		return "", false
+	}
+	rest := text[len(prefix):]
+	if rest != "" && !strings.ContainsAny(prefix[len(prefix)-1:], ":,>") && !strings.ContainsAny(rest[:1], " \t\n:,") {
+		return "", false
+	}
+	return trimSeparator(rest), true
 }
 
-// NewMessage returns a new Message that wraps a Slack message.
-func NewMessage(msg *slack.Msg) *Message {
-	return &Message{msg}
+// trimSeparator removes the punctuation and spaces found after an address.
+func trimSeparator(text string) string {
+	return strings.TrimSpace(strings.TrimLeft(text, ":,"))
 }
@@ -0,0 +1,149 @@
+package qubot
+
+import (
+	"testing"
+	"time"
+
+	"testutil"
+
+	"github.com/nlopes/slack"
+	"golang.org/x/net/context"
+)
+
+// Ensure that messages addressed to the bot are recognized and that the
+// address is removed from the text.
+func TestMessage_address(t *testing.T) {
+	tests := []struct {
+		channel   string
+		text      string
+		mention   bool
+		prefixed  bool
+		addressed bool
+		stripped  string
+	}{
+		{"C100", "ping", false, false, false, "ping"},
+		{"D100", " ping ", false, false, true, "ping"},
+		{"C100", "<@U999> ping", true, false, true, "ping"},
+		{"C100", "<@U999>: ping", true, false, true, "ping"},
+		{"C100", "<@U999|qubot>, ping", true, false, true, "ping"},
+		{"C100", "hey <@U999> ping", true, false, true, "hey <@U999> ping"},
+		{"C100", "<@U998> ping", false, false, false, "<@U998> ping"},
+		{"C100", "qubot: ping", false, true, true, "ping"},
+		{"C100", "Qubot,ping", false, true, true, "ping"},
+		{"C100", "@qubot ping", false, true, true, "ping"},
+		{"C100", "@qubots ping", false, false, false, "@qubots ping"},
+		{"C100", "qubot ping", false, false, false, "qubot ping"},
+	}
+	for _, tt := range tests {
+		msg := newMessage(&slack.Msg{Channel: tt.channel, Text: tt.text}, nil)
+		msg.address("U999", "qubot")
+		testutil.Equals(t, tt.mention, msg.IsMention)
+		testutil.Equals(t, tt.prefixed, msg.IsPrefixed)
+		testutil.Equals(t, tt.addressed, msg.Addressed())
+		testutil.Equals(t, tt.stripped, msg.Text)
+	}
+}
+
+// routerHandler implements the Handler interface, Handle and Match are
+// provided by the router.
+type routerHandler struct {
+	*Router
+}
+
+func (h *routerHandler) Start(ctx context.Context) error { return nil }
+
+// Ensure that handlers that only want addressed messages do not get the
+// rest.
+func TestSupervisedHandler_addressedOnly(t *testing.T) {
+	r := NewRouter()
+	var handled []string
+	r.Command("ping", func(ctx context.Context, res Response, msg *Message, _ *Args) {
+		handled = append(handled, msg.RawText)
+	})
+	r.RequireAddress()
+	sh := newSupervisedHandler(&routerHandler{r})
+
+	for _, text := range []string{"ping", "qubot: ping", "<@U999> ping"} {
+		msg := newMessage(&slack.Msg{Channel: "C100", Text: text}, nil)
+		msg.address("U999", "qubot")
+		sh.handle(context.Background(), NewResponse(&fakeMessenger{}, msg), msg)
+	}
+	testutil.Equals(t, []string{"qubot: ping", "<@U999> ping"}, handled)
+}
+
+// Ensure that edited and deleted messages are recognized and that the
+// attachments are kept.
+func TestNewMessage(t *testing.T) {
+	e := &slack.MessageEvent{
+		Msg: slack.Msg{Channel: "G100", SubType: "message_changed", Timestamp: "1000.02"},
+		SubMessage: &slack.Msg{User: "U100", Text: "hi!", Timestamp: "1000.01", ThreadTimestamp: "999.01",
+			Attachments: []slack.Attachment{{Title: "Issue", Fields: []slack.AttachmentField{{Title: "Status", Value: "New"}}}}},
+	}
+	msg := newEventMessage(e)
+	testutil.Assert(t, msg.Edited, "message should be edited")
+	testutil.Equals(t, "1000.01", msg.Timestamp)
+	testutil.Equals(t, "999.01", msg.ThreadTimestamp)
+	testutil.Equals(t, "U100", msg.User.ID)
+	testutil.Equals(t, "hi!", msg.Text)
+	testutil.Equals(t, PrivateChannel, msg.Channel.Type)
+	testutil.Equals(t, []Attachment{{Title: "Issue", Fields: []AttachmentField{{Title: "Status", Value: "New"}}}}, msg.Attachments)
+
+	msg = newEventMessage(&slack.MessageEvent{Msg: slack.Msg{Channel: "D100", SubType: "message_deleted", DeletedTimestamp: "1000.01"}})
+	testutil.Assert(t, msg.Deleted, "message should be deleted")
+	testutil.Assert(t, msg.IsDirect, "message should be direct")
+	testutil.Equals(t, "1000.01", msg.Timestamp)
+}
+
+// msgHandler implements the Handler interface and passes the messages it
+// gets through a channel.
+type msgHandler struct {
+	msgs chan *Message
+}
+
+func (h *msgHandler) Start(ctx context.Context) error { return nil }
+
+func (h *msgHandler) Handle(ctx context.Context, r Response, msg *Message) {
+	h.msgs <- msg
+}
+
+// Ensure that the sender and the channel of the messages are resolved.
+func TestQubot_resolveMessage(t *testing.T) {
+	q := InitTestQubot()
+	rtm := testRTM(q)
+	info := &slack.Info{Users: []slack.User{{ID: "U100", Name: "alice"}}}
+	info.Channels = append(info.Channels, slack.Channel{})
+	info.Channels[0].ID, info.Channels[0].Name = "C100", "general"
+	rtm.info = info
+	testutil.Ok(t, q.db.Update(func(tx *Tx) error {
+		return tx.SaveUser(&User{ID: "U200", Name: "bob", Email: "bob@example.com"})
+	}))
+
+	h := &msgHandler{msgs: make(chan *Message, 2)}
+	q.Handle(h)
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	rtm.events <- slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{}}
+	rtm.events <- *newTestMessageEvent("C100", "hi")
+	e := newTestMessageEvent("G100", "hello")
+	e.Data.(*slack.MessageEvent).User = "U200"
+	rtm.events <- *e
+
+	var msgs []*Message
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-h.msgs:
+			msgs = append(msgs, msg)
+		case <-time.After(time.Second * 5):
+			t.Fatal("message not handled")
+		}
+	}
+	if msgs[0].Channel.ID != "C100" {
+		msgs[0], msgs[1] = msgs[1], msgs[0]
+	}
+	testutil.Equals(t, "alice", msgs[0].User.Name)
+	testutil.Equals(t, "general", msgs[0].Channel.Name)
+	testutil.Equals(t, PublicChannel, msgs[0].Channel.Type)
+	testutil.Equals(t, "bob@example.com", msgs[1].User.Email)
+	testutil.Equals(t, &Channel{ID: "G100", Type: PrivateChannel}, msgs[1].Channel)
+}
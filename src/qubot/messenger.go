@@ -1,7 +1,10 @@
 package qubot
 
 import (
+	"errors"
+	"fmt"
 	"logger"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,48 +13,301 @@ import (
 	"github.com/Workiva/go-datastructures/queue"
 	"github.com/juju/ratelimit"
 	"github.com/nlopes/slack"
+	"github.com/sony/gobreaker"
+)
+
+// Default rate limits, in messages per second, and bucket capacities used when
+// the configuration does not provide them.
+const (
+	msnRateLimit        = 1.0
+	msnBurst            = 5
+	msnChannelRateLimit = 1.0
+	msnChannelBurst     = 2
 )
 
-const msnRateLimit = 1.0
 const msnPollWaitTime = 500 * time.Millisecond
 
+// msnPollMaxItems is the maximum number of messages taken from a queue at
+// once, large enough to drain the queue under normal circumstances.
+const msnPollMaxItems = 100
+
+// Delivery confirmation settings: how long we wait for the acknowledgement of
+// a message, how many times it is posted again and how long we wait between
+// attempts, doubling the wait time after each failure.
+const (
+	msnAckTimeout = 5 * time.Second
+	msnRetries    = 3
+	msnBackoffMin = 500 * time.Millisecond
+	msnBackoffMax = 10 * time.Second
+)
+
+// The circuit breaker of a channel trips after msnBreakerFailures consecutive
+// failures and lets a new attempt through after msnBreakerTimeout.
+const (
+	msnBreakerFailures = 5
+	msnBreakerTimeout  = 30 * time.Second
+)
+
+// msnShutdownTimeout is how long the messenger waits by default for the
+// pending messages to be delivered when it is shut down.
+const msnShutdownTimeout = 10 * time.Second
+
+// msnOutboxMaxAge is how old a message found in the outbox can be by default
+// to be posted after a start, older messages are dropped.
+const msnOutboxMaxAge = 15 * time.Minute
+
+// msnMinSplitLength is the length, in bytes, under which a message that Slack
+// finds too long is not split any further.
+const msnMinSplitLength = 100
+
+// ErrMessengerClosed is returned when a message is sent after the messenger
+// has been shut down.
+var ErrMessengerClosed = errors.New("messenger: closed")
+
 // Messenger interface
 type Messenger interface {
-	Send(msg *slack.OutgoingMessage) error
+	// Send queues the message. The Delivery returned can be used by the
+	// caller to wait until the message has been posted.
+	Send(msg *OutgoingMessage) (*Delivery, error)
+
+	// Shutdown stops accepting new messages and waits until the queued
+	// messages are delivered or the context is done, then it closes the
+	// messenger.
+	Shutdown(ctx context.Context) error
+
+	// Close stops the messenger right away, the queued messages are
+	// dropped.
 	Close()
 }
 
+// An Editor is a Messenger that can change the messages once they are posted
+// and react to them. The messages are identified by their channel and
+// timestamp, see Delivery.Timestamp.
+type Editor interface {
+	// Update replaces the text and the attachments of the message.
+	Update(channel, ts string, msg *OutgoingMessage) error
+
+	// Delete removes the message.
+	Delete(channel, ts string) error
+
+	// React adds a reaction to the message, name is the name of an emoji
+	// without colons.
+	React(channel, ts, name string) error
+}
+
 // Messenger posts Qubot's messages to Slack respecting their API rate limit
-// policy (see https://api.slack.com/docs/rate-limits for more details). We are
-// assuming though that Slack is applying the rule per channel and not per
-// client.
+// policy (see https://api.slack.com/docs/rate-limits for more details). Slack
+// applies the limit to the whole workspace so every message has to get a
+// token from a global bucket shared by all the channels. Each channel has its
+// own bucket too so a busy channel can not starve the others. Both buckets
+// allow short bursts, their rate and capacity are configurable.
 //
 // If we have more than one message waiting to be delivered for a specific
-// channel, we will group them together to avoid extra posting.
+// channel, we will group them together to avoid extra posting. Messages that
+// are too long for Slack are split in parts, see splitText, which are posted
+// in order by the poller of the channel before the next message.
+//
+// Plain messages are posted through the RTM API. Rich messages, see
+// OutgoingMessage.Rich, are posted through the Web API when the messenger has
+// a client for it, otherwise only their text is posted. The Web API is used to
+// change the messages already posted too, see Editor.
+//
+// Messages are only posted while the client is connected, see setConnected,
+// otherwise they would pile up in the client until it reconnects and be
+// posted again when their acknowledgements time out. Every message posted is
+// given an ID and the poller waits until Slack acknowledges it. Messages that fail are posted again after a while. If Slack
+// keeps failing, the circuit breaker of the channel stops the attempts for some
+// time. Each channel has its own breaker because Slack does not say which
+// message it rejected, the messages to a channel that does not accept them are
+// only noticed when their acknowledgements time out, and that should not stop
+// the rest of the channels.
 //
-// TODO: allow bursts
-// TODO: group messages
+// When a database is given, the messages are kept in its outbox until they are
+// delivered or fail for good so the ones that are still pending when Qubot
+// stops, or that could not be posted for a while, are posted after the next
+// start.
 type messenger struct {
-	ctx context.Context
-	wg  sync.WaitGroup
-	rtm slackRTMClient
-	chq *chqueue
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	rtm    slackRTMClient
+	web    slackWebClient
+	db     *DB
+	chq    *chqueue
+	tb     *ratelimit.Bucket
+	config MessengerConfig
+
+	ids        slack.IDGenerator
+	acks       *acks
+	ackTimeout time.Duration
+	maxAge     time.Duration
+	retries    int
+	backoffMin time.Duration
+	backoffMax time.Duration
+
+	// online is closed while the client is connected, omux protects it.
+	online chan struct{}
+	omux   sync.Mutex
+
+	// cbs are the circuit breakers of the channels, see breaker.
+	cbs   map[string]*gobreaker.CircuitBreaker
+	cbmux sync.Mutex
+
+	// closing is closed when the messenger is shut down, mux protects it
+	// from concurrent senders.
+	closing chan struct{}
+	mux     sync.RWMutex
 }
 
-// InitMessenger returns a new Messenger object.
-func InitMessenger(ctx context.Context, rtm slackRTMClient) Messenger {
+// InitMessenger returns a new Messenger object. The default limits are used
+// when config is nil or some of its values are not set. The messages found in
+// the outbox of the database are queued again, db can be nil. web can be nil
+// too, the rich features are not available then.
+func InitMessenger(ctx context.Context, rtm slackRTMClient, web slackWebClient, db *DB, config *MessengerConfig) Messenger {
 	m := messenger{
-		ctx: ctx,
-		rtm: rtm,
-		chq: &chqueue{q: make(map[string]*queue.Queue)},
+		rtm:  rtm,
+		web:  web,
+		db:   db,
+		chq:  &chqueue{q: make(map[string]*queue.Queue)},
+		ids:  slack.NewSafeID(1),
+		acks: &acks{pending: make(map[int]chan ackResult)},
+		cbs:  make(map[string]*gobreaker.CircuitBreaker),
+
+		online: make(chan struct{}),
+
+		ackTimeout: msnAckTimeout,
+		maxAge:     config.outboxMaxAge(),
+		retries:    msnRetries,
+		backoffMin: msnBackoffMin,
+		backoffMax: msnBackoffMax,
+
+		closing: make(chan struct{}),
+
+		config: MessengerConfig{
+			Rate:         msnRateLimit,
+			Burst:        msnBurst,
+			ChannelRate:  msnChannelRateLimit,
+			ChannelBurst: msnChannelBurst,
+		},
+	}
+	if config != nil {
+		if config.Rate > 0 {
+			m.config.Rate = config.Rate
+		}
+		if config.Burst > 0 {
+			m.config.Burst = config.Burst
+		}
+		if config.ChannelRate > 0 {
+			m.config.ChannelRate = config.ChannelRate
+		}
+		if config.ChannelBurst > 0 {
+			m.config.ChannelBurst = config.ChannelBurst
+		}
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	// The client is assumed to be connected until told otherwise.
+	close(m.online)
+	m.tb = ratelimit.NewBucketWithRate(m.config.Rate, int64(m.config.Burst))
+	if err := m.replay(); err != nil {
+		logger.Error("messenger", "Outbox could not be replayed", "error", err)
 	}
 
 	return &m
 }
 
-// Send puts the message in its corresponding queue.
-func (m *messenger) Send(msg *slack.OutgoingMessage) error {
-	q, new, err := m.chq.add(msg)
+// replay queues the messages found in the outbox. The messages older than
+// maxAge are dropped, they would arrive out of time and after the newer ones,
+// or they may have been posted already and their acknowledgements were late.
+func (m *messenger) replay() error {
+	if m.db == nil {
+		return nil
+	}
+	var msgs []*OutboxMessage
+	err := m.db.View(func(tx *Tx) (err error) {
+		msgs, err = tx.OutboxMessages()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var queued int
+	for _, om := range msgs {
+		if age := time.Since(om.Creation); age > m.maxAge {
+			logger.Warn("messenger", "Dropping old message from the outbox", "channel", om.Channel, "age", age, "text", om.Text)
+			err := m.db.Update(func(tx *Tx) error {
+				return tx.DeleteOutboxMessage(om.Seq)
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		queued++
+		msg := &OutgoingMessage{
+			Channel:         om.Channel,
+			Text:            om.Text,
+			ThreadTimestamp: om.ThreadTimestamp,
+			Attachments:     om.Attachments,
+			Broadcast:       om.Broadcast,
+			Username:        om.Username,
+			IconURL:         om.IconURL,
+			IconEmoji:       om.IconEmoji,
+		}
+		m.enqueue(&outgoing{msg: msg, ds: []*Delivery{newDelivery()}, seqs: []int64{om.Seq}})
+	}
+	if queued > 0 {
+		logger.Info("messenger", fmt.Sprintf("%d messages found in the outbox", queued))
+	}
+	return nil
+}
+
+// Send puts the message in its corresponding queue. Messages addressed to a
+// user ID are delivered to the IM channel of that user.
+func (m *messenger) Send(msg *OutgoingMessage) (*Delivery, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	select {
+	case <-m.closing:
+		return nil, ErrMessengerClosed
+	default:
+	}
+
+	if isUserID(msg.Channel) {
+		ch, err := m.imChannel(msg.Channel)
+		if err != nil {
+			return nil, err
+		}
+		msg.Channel = ch
+	}
+
+	o := &outgoing{msg: msg, ds: []*Delivery{newDelivery()}}
+	if m.db != nil {
+		om := &OutboxMessage{
+			Channel:         msg.Channel,
+			Text:            msg.Text,
+			ThreadTimestamp: msg.ThreadTimestamp,
+			Creation:        time.Now(),
+			Attachments:     msg.Attachments,
+			Broadcast:       msg.Broadcast,
+			Username:        msg.Username,
+			IconURL:         msg.IconURL,
+			IconEmoji:       msg.IconEmoji,
+		}
+		err := m.db.Update(func(tx *Tx) error {
+			return tx.SaveOutboxMessage(om)
+		})
+		if err != nil {
+			return nil, err
+		}
+		o.seqs = []int64{om.Seq}
+	}
+
+	return o.ds[0], m.enqueue(o)
+}
+
+// enqueue puts the message in the queue of its channel.
+func (m *messenger) enqueue(o *outgoing) error {
+	q, new, err := m.chq.add(o)
 	if err != nil || !new {
 		return err
 	}
@@ -69,33 +325,425 @@ func (m *messenger) Send(msg *slack.OutgoingMessage) error {
 	return nil
 }
 
-// startPoller creates a new goroutine for a channel.
-// TODO: confirm delivery or retry instead (circuitbreaker?)
+// imChannel returns the ID of the IM channel of a user. The channel is opened
+// when the bot has not talked to the user before.
+func (m *messenger) imChannel(user string) (string, error) {
+	if info := m.rtm.GetInfo(); info != nil {
+		for _, im := range info.IMs {
+			if im.User == user {
+				return im.ID, nil
+			}
+		}
+	}
+	_, _, id, err := m.rtm.OpenIMChannel(user)
+	if err != nil {
+		return "", fmt.Errorf("messenger: cannot open IM channel with %s: %s", user, err)
+	}
+	return id, nil
+}
+
+// startPoller creates a new goroutine for a channel. Every time the poller
+// wakes up it takes all the messages waiting in the queue and merges them so
+// they can be posted together. When the messenger is shut down the poller
+// returns as soon as the queue is empty.
 func (m *messenger) startPoller(q *queue.Queue) {
 	logger.Debug("messenger", "Starting new poller goroutine")
-	tb := ratelimit.NewBucketWithRate(msnRateLimit, 1)
+	tb := ratelimit.NewBucketWithRate(m.config.ChannelRate, int64(m.config.ChannelBurst))
 	for {
 		select {
 		case <-m.ctx.Done():
 			logger.Debug("messenger", "Closing poller")
 			return
+		case <-m.closing:
+			// Nothing can be added to the queue once we are closing.
+			if q.Empty() {
+				logger.Debug("messenger", "Closing drained poller")
+				return
+			}
 		default:
-			res, err := q.Poll(1, msnPollWaitTime)
-			if err != nil {
-				if err != queue.ErrTimeout {
-					logger.Warn("messenger", "startPoller", "error", err)
-				}
-				continue
+		}
+		res, err := q.Poll(msnPollMaxItems, msnPollWaitTime)
+		if err != nil {
+			if err != queue.ErrTimeout {
+				logger.Warn("messenger", "startPoller", "error", err)
+			}
+			continue
+		}
+		items := make([]*outgoing, len(res))
+		for i, item := range res {
+			items[i] = item.(*outgoing)
+		}
+		for _, o := range coalesce(items, slack.MaxMessageTextLength) {
+			m.deliver(tb, o)
+			m.clear(o)
+		}
+	}
+}
+
+// deliver posts the message and resolves its deliveries. A message that is
+// too long is split and its parts are posted in order, the deliveries get the
+// timestamp of the first part. The attachments follow the last part.
+func (m *messenger) deliver(tb *ratelimit.Bucket, o *outgoing) {
+	o.resolve(m.postParts(tb, o.msg, splitText(o.msg.Text, slack.MaxMessageTextLength)))
+}
+
+// postParts posts the parts of a message one after the other and stops at the
+// first one that fails. A part that Slack finds too long is split again in
+// smaller parts, down to msnMinSplitLength bytes.
+func (m *messenger) postParts(tb *ratelimit.Bucket, msg *OutgoingMessage, texts []string) (string, error) {
+	var first string
+	for i, text := range texts {
+		part := *msg
+		part.Text = text
+		if i < len(texts)-1 {
+			part.Attachments = nil
+		}
+		res := m.retry(tb, &part)
+		if e, ok := res.err.(*slack.MessageTooLongEvent); ok {
+			max := e.MaxLength
+			if len(text) <= max {
+				max = len(text) / 2
+			}
+			if max >= msnMinSplitLength {
+				logger.Info("messenger", "Message too long, splitting it", "channel", msg.Channel, "length", len(text), "max", max)
+				res.ts, res.err = m.postParts(tb, &part, splitText(text, max))
+			}
+		}
+		if res.err != nil {
+			return "", res.err
+		}
+		if first == "" {
+			first = res.ts
+		}
+	}
+	return first, nil
+}
+
+// retry posts the message again with an exponential backoff when it fails,
+// unless the failure is permanent, see permanent, or the circuit breaker is
+// open. When Slack asks us to slow down the next attempt waits at least as
+// long as it asked.
+func (m *messenger) retry(tb *ratelimit.Bucket, msg *OutgoingMessage) ackResult {
+	var res ackResult
+	backoff := m.backoffMin
+	for attempt := 0; attempt <= m.retries; attempt++ {
+		if attempt > 0 {
+			wait := backoff
+			if d := retryAfter(res.err); d > wait {
+				wait = d
+			}
+			select {
+			case <-time.After(wait):
+			case <-m.ctx.Done():
+				return ackResult{err: m.ctx.Err()}
+			}
+			if backoff *= 2; backoff > m.backoffMax {
+				backoff = m.backoffMax
 			}
-			msg := res[0].(*slack.OutgoingMessage)
-			m.rtm.SendMessage(msg)
-			tb.Wait(1) // and relax for a bit!
 		}
+		v, err := m.breaker(msg.Channel).Execute(func() (interface{}, error) {
+			res := m.post(tb, msg)
+			if permanent(res.err) || retryAfter(res.err) > 0 {
+				// Not Slack's fault, or Slack is fine but busy, the
+				// breaker should not count it.
+				return res, nil
+			}
+			return res, res.err
+		})
+		if v == nil {
+			// The breaker did not let the message through.
+			res = ackResult{err: err}
+		} else {
+			res = v.(ackResult)
+		}
+		if res.err == nil || permanent(res.err) {
+			break
+		}
+		logger.Warn("messenger", "Message delivery failed", "channel", msg.Channel, "attempt", attempt+1, "error", res.err)
+	}
+	return res
+}
+
+// breaker returns the circuit breaker of the channel, it is created the first
+// time.
+func (m *messenger) breaker(channel string) *gobreaker.CircuitBreaker {
+	m.cbmux.Lock()
+	defer m.cbmux.Unlock()
+
+	cb, ok := m.cbs[channel]
+	if !ok {
+		cb = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:    channel,
+			Timeout: msnBreakerTimeout,
+			ReadyToTrip: func(counts gobreaker.Counts) bool {
+				return counts.ConsecutiveFailures >= msnBreakerFailures
+			},
+			OnStateChange: func(name string, from, to gobreaker.State) {
+				logger.Warn("messenger", "Circuit breaker state changed", "channel", name, "from", from, "to", to)
+			},
+		})
+		m.cbs[channel] = cb
+	}
+	return cb
+}
+
+// permanent reports whether the failure to post a message will happen again
+// if it is posted again as it is.
+func permanent(err error) bool {
+	switch e := err.(type) {
+	case *slack.MessageTooLongEvent:
+		return true
+	case *webError:
+		return e.permanent()
+	}
+	return false
+}
+
+// post sends the message with a new ID and waits for its acknowledgement.
+// Rich messages are posted through the Web API, which answers right away.
+func (m *messenger) post(tb *ratelimit.Bucket, msg *OutgoingMessage) ackResult {
+	if err := m.waitOnline(); err != nil {
+		return ackResult{err: err}
+	}
+	// Wait for our turn in the channel and then in the workspace.
+	if err := m.wait(tb); err != nil {
+		return ackResult{err: err}
+	}
+	if err := m.wait(m.tb); err != nil {
+		return ackResult{err: err}
+	}
+
+	if msg.Rich() {
+		if m.web != nil {
+			ts, err := m.web.PostMessage(msg)
+			return ackResult{ts: ts, err: err}
+		}
+		logger.Debug("messenger", "Web API not available, posting the text only", "channel", msg.Channel)
+	}
+
+	out := &slack.OutgoingMessage{
+		ID:              m.ids.Next(),
+		Type:            "message",
+		Channel:         msg.Channel,
+		Text:            msg.Text,
+		ThreadTimestamp: msg.ThreadTimestamp,
+	}
+	ch := m.acks.expect(out.ID)
+	// The client blocks when its buffer is full, don't let it block the
+	// poller once the messenger is closed.
+	sent := make(chan struct{})
+	go func() {
+		m.rtm.SendMessage(out)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-m.ctx.Done():
+		m.acks.forget(out.ID)
+		return ackResult{err: m.ctx.Err()}
+	}
+
+	select {
+	case res := <-ch:
+		return res
+	case <-time.After(m.ackTimeout):
+		m.acks.forget(out.ID)
+		return ackResult{err: errAckTimeout}
+	case <-m.ctx.Done():
+		m.acks.forget(out.ID)
+		return ackResult{err: m.ctx.Err()}
+	}
+}
+
+// waitOnline waits until the client is connected unless the messenger is
+// closed first.
+func (m *messenger) waitOnline() error {
+	m.omux.Lock()
+	online := m.online
+	m.omux.Unlock()
+	select {
+	case <-online:
+		return nil
+	case <-m.ctx.Done():
+		return m.ctx.Err()
+	}
+}
+
+// setConnected implements the deliveryTracker interface.
+func (m *messenger) setConnected(connected bool) {
+	m.omux.Lock()
+	defer m.omux.Unlock()
+
+	select {
+	case <-m.online:
+		if !connected {
+			m.online = make(chan struct{})
+		}
+	default:
+		if connected {
+			close(m.online)
+		}
+	}
+}
+
+// wait takes a token from the bucket, waiting until it is available unless
+// the messenger is closed first.
+func (m *messenger) wait(tb *ratelimit.Bucket) error {
+	d := tb.Take(1)
+	if d == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-m.ctx.Done():
+		return m.ctx.Err()
 	}
 }
 
+// clear removes the message from the outbox once it has been delivered or
+// failed for good, see permanent. The rest, e.g. the messages interrupted by a
+// shutdown or stopped by the circuit breaker, are kept to be posted again
+// after the next start.
+func (m *messenger) clear(o *outgoing) {
+	if m.db == nil || len(o.seqs) == 0 {
+		return
+	}
+	if err := o.ds[0].Err(); err != nil && !permanent(err) {
+		return
+	}
+	err := m.db.Update(func(tx *Tx) error {
+		for _, seq := range o.seqs {
+			if err := tx.DeleteOutboxMessage(seq); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("messenger", "Outbox could not be updated", "error", err)
+	}
+}
+
+// ack implements the deliveryTracker interface.
+func (m *messenger) ack(id int, ts string, err error) {
+	if !m.acks.resolve(id, ackResult{ts: ts, err: err}) {
+		logger.Debug("messenger", "Unexpected acknowledgement", "id", id)
+	}
+}
+
+// Update implements the Editor interface. The change waits for its turn in the
+// workspace but not in the queue of the channel.
+func (m *messenger) Update(channel, ts string, msg *OutgoingMessage) error {
+	return m.edit(func() error {
+		return m.web.UpdateMessage(channel, ts, msg)
+	})
+}
+
+// Delete implements the Editor interface.
+func (m *messenger) Delete(channel, ts string) error {
+	return m.edit(func() error {
+		return m.web.DeleteMessage(channel, ts)
+	})
+}
+
+// React implements the Editor interface.
+func (m *messenger) React(channel, ts, name string) error {
+	return m.edit(func() error {
+		return m.web.AddReaction(channel, ts, strings.Trim(name, ":"))
+	})
+}
+
+// edit calls the Web API once there is a token in the global bucket.
+func (m *messenger) edit(fn func() error) error {
+	if m.web == nil {
+		return errWebUnavailable
+	}
+	select {
+	case <-m.closing:
+		return ErrMessengerClosed
+	default:
+	}
+	if err := m.wait(m.tb); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// outgoing is a message waiting in the queue along with the deliveries that
+// will be resolved when the message is posted and its sequence numbers in the
+// outbox. Messages that are merged share the same fate.
+type outgoing struct {
+	msg  *OutgoingMessage
+	ds   []*Delivery
+	seqs []int64
+}
+
+func (o *outgoing) resolve(ts string, err error) {
+	for _, d := range o.ds {
+		d.resolve(ts, err)
+	}
+}
+
+// coalesce merges consecutive messages addressed to the same thread into a
+// single message, separating their texts with a new line. The order of the
+// messages is preserved and the merged texts never exceed max bytes.
+// Messages that are already too long and rich messages are left untouched.
+func coalesce(items []*outgoing, max int) []*outgoing {
+	var res []*outgoing
+	var last *outgoing
+	for _, o := range items {
+		if last != nil && !last.msg.Rich() && !o.msg.Rich() &&
+			last.msg.ThreadTimestamp == o.msg.ThreadTimestamp &&
+			len(last.msg.Text)+1+len(o.msg.Text) <= max {
+			last.msg.Text += "\n" + o.msg.Text
+			last.ds = append(last.ds, o.ds...)
+			last.seqs = append(last.seqs, o.seqs...)
+			continue
+		}
+		msg := *o.msg
+		last = &outgoing{
+			msg:  &msg,
+			ds:   append([]*Delivery(nil), o.ds...),
+			seqs: append([]int64(nil), o.seqs...),
+		}
+		res = append(res, last)
+	}
+	return res
+}
+
+// Shutdown implements the Messenger interface. The pollers are stopped when
+// the context is done before they manage to deliver all the messages, these
+// are kept in the outbox.
+func (m *messenger) Shutdown(ctx context.Context) error {
+	m.mux.Lock()
+	select {
+	case <-m.closing:
+	default:
+		close(m.closing)
+	}
+	m.mux.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		logger.Warn("messenger", "Pending messages could not be delivered before the deadline")
+	}
+	m.Close()
+	return err
+}
+
 // Close signals all the goroutines and waits until they are all done.
 func (m *messenger) Close() {
+	m.cancel()
 	m.wg.Wait()
 }
 
@@ -110,20 +758,24 @@ type chqueue struct {
 // add outgoing message to the corresponding channel queue, returns a pointer
 // to the queue, a boolean where true means that the queue had to be created and
 // false otherwise and an error if the message could not be added to the queue.
-func (chq *chqueue) add(msg *slack.OutgoingMessage) (*queue.Queue, bool, error) {
-	q := chq.get(msg.Channel)
+func (chq *chqueue) add(o *outgoing) (*queue.Queue, bool, error) {
+	q := chq.get(o.msg.Channel)
 
 	created := false
 	if q == nil {
-		q = queue.New(10)
-		created = true
-
+		// Check again while holding the write lock, another writer may
+		// have created the queue in the meantime.
 		chq.mux.Lock()
-		chq.q[msg.Channel] = q
+		q = chq.q[o.msg.Channel]
+		if q == nil {
+			q = queue.New(10)
+			created = true
+			chq.q[o.msg.Channel] = q
+		}
 		chq.mux.Unlock()
 	}
 
-	err := q.Put(msg)
+	err := q.Put(o)
 
 	return q, created, err
 }
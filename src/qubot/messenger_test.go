@@ -0,0 +1,586 @@
+package qubot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"testutil"
+
+	"github.com/nlopes/slack"
+	"github.com/sony/gobreaker"
+	"golang.org/x/net/context"
+)
+
+// newTestMessenger returns a messenger that gets the acknowledgements of the
+// messages straight from the fake RTM client.
+func newTestMessenger(rtm *fakeSlackRTMClient, db *DB, config *MessengerConfig) (*messenger, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var m *messenger
+	ready := make(chan struct{})
+	rtm.onSend = func(msg *slack.OutgoingMessage) {
+		<-ready
+		m.ack(msg.ID, fmt.Sprintf("1000.%02d", msg.ID), nil)
+	}
+	m = InitMessenger(ctx, rtm, nil, db, config).(*messenger)
+	close(ready)
+	return m, cancel
+}
+
+// fastMessengerConfig does not make the tests wait for the rate limiters.
+var fastMessengerConfig = &MessengerConfig{Rate: 100, Burst: 10, ChannelRate: 100, ChannelBurst: 10}
+
+// send discards the delivery returned by Messenger.Send.
+func send(m Messenger, msg *OutgoingMessage) error {
+	_, err := m.Send(msg)
+	return err
+}
+
+// receiveLines collects the lines of the messages sent through the fake RTM
+// client until n lines have been received or the timeout expires.
+func receiveLines(rtm *fakeSlackRTMClient, n int, timeout time.Duration) (msgs []*slack.OutgoingMessage, lines []string) {
+	expired := time.After(timeout)
+	for len(lines) < n {
+		select {
+		case msg := <-rtm.sent:
+			msgs = append(msgs, msg)
+			lines = append(lines, strings.Split(msg.Text, "\n")...)
+		case <-expired:
+			return
+		}
+	}
+	return
+}
+
+// Ensure that a burst of messages for a channel is posted in fewer messages.
+func TestMessenger_coalesce(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, nil)
+	defer m.Close()
+	defer cancel()
+
+	var texts []string
+	for i := 0; i < 10; i++ {
+		text := fmt.Sprintf("message %d", i)
+		texts = append(texts, text)
+		testutil.Ok(t, send(m, &OutgoingMessage{Channel: "C100", Text: text}))
+	}
+
+	// Only the first message can be delivered before the poller has to
+	// wait for the rate limiter, the rest are grouped.
+	msgs, lines := receiveLines(rtm, len(texts), time.Second*5)
+	testutil.Equals(t, texts, lines)
+	testutil.Assert(t, len(msgs) < len(texts), "expected fewer than %d messages, got %d", len(texts), len(msgs))
+}
+
+// Ensure that messages are merged in order, respecting the length limit and
+// the threads they belong to.
+func TestCoalesce(t *testing.T) {
+	var items []*outgoing
+	for _, msg := range []*OutgoingMessage{
+		{Channel: "C100", Text: "aaaa"},
+		{Channel: "C100", Text: "bbbb"},
+		{Channel: "C100", Text: "cccc"},
+		{Channel: "C100", Text: "dddd", ThreadTimestamp: "1000.01"},
+		{Channel: "C100", Text: "eeeeeeeeeeee", ThreadTimestamp: "1000.01"},
+		{Channel: "C100", Text: "ffff"},
+	} {
+		items = append(items, &outgoing{msg: msg, ds: []*Delivery{newDelivery()}})
+	}
+	res := coalesce(items, 10)
+
+	var msgs []*OutgoingMessage
+	for _, o := range res {
+		msgs = append(msgs, o.msg)
+	}
+	testutil.Equals(t, []*OutgoingMessage{
+		{Channel: "C100", Text: "aaaa\nbbbb"},
+		{Channel: "C100", Text: "cccc"},
+		{Channel: "C100", Text: "dddd", ThreadTimestamp: "1000.01"},
+		{Channel: "C100", Text: "eeeeeeeeeeee", ThreadTimestamp: "1000.01"},
+		{Channel: "C100", Text: "ffff"},
+	}, msgs)
+
+	// Merged messages share their deliveries.
+	testutil.Equals(t, []*Delivery{items[0].ds[0], items[1].ds[0]}, res[0].ds)
+
+	// The original messages are not modified.
+	testutil.Equals(t, "aaaa", items[0].msg.Text)
+}
+
+// Ensure that the global bucket is shared by all the channels.
+func TestMessenger_globalRateLimit(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, &MessengerConfig{Rate: 5, Burst: 2, ChannelRate: 100, ChannelBurst: 10})
+	defer m.Close()
+	defer cancel()
+
+	for i := 0; i < 6; i++ {
+		testutil.Ok(t, send(m, &OutgoingMessage{Channel: fmt.Sprintf("C10%d", i), Text: "hi"}))
+	}
+
+	// The burst goes out right away, the rest has to wait for new tokens.
+	msgs, _ := receiveLines(rtm, 6, time.Millisecond*100)
+	testutil.Equals(t, 2, len(msgs))
+	msgs, _ = receiveLines(rtm, 4, time.Second*5)
+	testutil.Equals(t, 4, len(msgs))
+}
+
+// Ensure that a channel can burst up to the capacity of its bucket.
+func TestMessenger_channelRateLimit(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, &MessengerConfig{Rate: 100, Burst: 10, ChannelRate: 1, ChannelBurst: 3})
+	defer m.Close()
+	defer cancel()
+
+	// Messages in different threads can not be grouped.
+	for i := 0; i < 5; i++ {
+		testutil.Ok(t, send(m, &OutgoingMessage{Channel: "C100", Text: "hi", ThreadTimestamp: fmt.Sprintf("100%d.01", i)}))
+	}
+
+	msgs, _ := receiveLines(rtm, 5, time.Millisecond*300)
+	testutil.Equals(t, 3, len(msgs))
+	for i, msg := range msgs {
+		testutil.Equals(t, fmt.Sprintf("100%d.01", i), msg.ThreadTimestamp)
+	}
+}
+
+// Ensure that the delivery is resolved when Slack acknowledges the message.
+func TestMessenger_delivery(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+
+	d, err := m.Send(&OutgoingMessage{Channel: "C100", Text: "hi"})
+	testutil.Ok(t, err)
+	testutil.Ok(t, d.Wait(context.Background()))
+	testutil.Equals(t, "1000.01", d.Timestamp())
+}
+
+// Ensure that failed messages are posted again.
+func TestMessenger_retry(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+	m.backoffMin = time.Millisecond
+
+	failures := 2
+	rtm.onSend = func(msg *slack.OutgoingMessage) {
+		if failures > 0 {
+			failures--
+			m.ack(msg.ID, "", errors.New("broken pipe"))
+			return
+		}
+		m.ack(msg.ID, "1000.01", nil)
+	}
+
+	d, err := m.Send(&OutgoingMessage{Channel: "C100", Text: "hi"})
+	testutil.Ok(t, err)
+	testutil.Ok(t, d.Wait(context.Background()))
+	testutil.Equals(t, 3, len(rtm.sent))
+
+	// Every attempt uses a different message ID.
+	ids := map[int]bool{}
+	for i := 0; i < 3; i++ {
+		ids[(<-rtm.sent).ID] = true
+	}
+	testutil.Equals(t, 3, len(ids))
+}
+
+// Ensure that messages that are not acknowledged are posted again and that
+// the delivery fails when Slack does not recover.
+func TestMessenger_ackTimeout(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+	m.backoffMin = time.Millisecond
+	m.ackTimeout = time.Millisecond * 10
+	rtm.onSend = nil
+
+	d, err := m.Send(&OutgoingMessage{Channel: "C100", Text: "hi"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, errAckTimeout, d.Wait(context.Background()))
+	testutil.Equals(t, msnRetries+1, len(rtm.sent))
+}
+
+// Ensure that nothing is posted while the client is disconnected and that the
+// messages are posted once, when it connects again.
+func TestMessenger_offline(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+	m.setConnected(false)
+
+	d, err := m.Send(&OutgoingMessage{Channel: "C100", Text: "hi"})
+	testutil.Ok(t, err)
+	select {
+	case <-rtm.sent:
+		t.Fatal("message posted while disconnected")
+	case <-time.After(msnPollWaitTime * 2):
+	}
+
+	m.setConnected(true)
+	testutil.Ok(t, d.Wait(context.Background()))
+	testutil.Equals(t, 1, len(rtm.sent))
+}
+
+// Ensure that the messenger can be closed while the client blocks.
+func TestMessenger_closeBlocked(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer cancel()
+	block := make(chan struct{})
+	defer close(block)
+	rtm.onSend = func(msg *slack.OutgoingMessage) { <-block }
+
+	testutil.Ok(t, send(m, &OutgoingMessage{Channel: "C100", Text: "hi"}))
+	<-rtm.sent
+
+	closed := make(chan struct{})
+	go func() {
+		m.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("messenger not closed")
+	}
+}
+
+// Ensure that messages that are too long are not posted again.
+func TestMessenger_tooLong(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+	rtm.onSend = func(msg *slack.OutgoingMessage) {
+		m.ack(msg.ID, "", &slack.MessageTooLongEvent{Message: *msg, MaxLength: 4000})
+	}
+
+	d, err := m.Send(&OutgoingMessage{Channel: "C100", Text: "hi"})
+	testutil.Ok(t, err)
+	_, ok := d.Wait(context.Background()).(*slack.MessageTooLongEvent)
+	testutil.Assert(t, ok, "expected MessageTooLongEvent")
+	testutil.Equals(t, 1, len(rtm.sent))
+	testutil.Equals(t, gobreaker.StateClosed, m.breaker("C100").State())
+}
+
+// Ensure that long messages are posted in parts, in order and before the
+// messages sent after them.
+func TestMessenger_split(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+
+	var lines []string
+	for i := 0; len(strings.Join(lines, "\n")) <= slack.MaxMessageTextLength*2; i++ {
+		lines = append(lines, fmt.Sprintf("line %d of a long report", i))
+	}
+	d, err := m.Send(&OutgoingMessage{Channel: "C100", Text: strings.Join(lines, "\n")})
+	testutil.Ok(t, err)
+	testutil.Ok(t, send(m, &OutgoingMessage{Channel: "C100", Text: "done"}))
+
+	msgs, got := receiveLines(rtm, len(lines)+1, time.Second*5)
+	testutil.Equals(t, append(lines, "done"), got)
+	testutil.Assert(t, len(msgs) >= 3, "expected at least 3 messages, got %d", len(msgs))
+	for _, msg := range msgs {
+		testutil.Assert(t, len(msg.Text) <= slack.MaxMessageTextLength, "message of %d bytes", len(msg.Text))
+	}
+	testutil.Ok(t, d.Wait(context.Background()))
+	testutil.Equals(t, "1000.01", d.Timestamp())
+}
+
+// Ensure that messages that Slack finds too long are split again.
+func TestMessenger_resplit(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+	rtm.onSend = func(msg *slack.OutgoingMessage) {
+		if len(msg.Text) > 150 {
+			m.ack(msg.ID, "", &slack.MessageTooLongEvent{Message: *msg, MaxLength: 150})
+			return
+		}
+		m.ack(msg.ID, fmt.Sprintf("1000.%02d", msg.ID), nil)
+	}
+
+	lines := []string{"```"}
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	lines = append(lines, "```")
+	d, err := m.Send(&OutgoingMessage{Channel: "C100", Text: strings.Join(lines, "\n")})
+	testutil.Ok(t, err)
+	testutil.Ok(t, d.Wait(context.Background()))
+	testutil.Equals(t, "1000.02", d.Timestamp())
+
+	var got []string
+	for len(rtm.sent) > 0 {
+		msg := <-rtm.sent
+		if msg.ID == 1 {
+			continue
+		}
+		testutil.Assert(t, len(msg.Text) <= 150, "message of %d bytes", len(msg.Text))
+		testutil.Assert(t, strings.HasPrefix(msg.Text, fence+"\n") && strings.HasSuffix(msg.Text, "\n"+fence), "unbalanced message %q", msg.Text)
+		for _, line := range strings.Split(msg.Text, "\n") {
+			if line != fence {
+				got = append(got, line)
+			}
+		}
+	}
+	testutil.Equals(t, lines[1:len(lines)-1], got)
+}
+
+// Ensure that the circuit breaker opens when Slack keeps failing.
+func TestMessenger_breaker(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+	m.backoffMin = time.Millisecond
+	m.retries = msnBreakerFailures + 2
+	rtm.onSend = func(msg *slack.OutgoingMessage) {
+		m.ack(msg.ID, "", errors.New("broken pipe"))
+	}
+
+	d, err := m.Send(&OutgoingMessage{Channel: "C100", Text: "hi"})
+	testutil.Ok(t, err)
+	err = d.Wait(context.Background())
+	testutil.Assert(t, err != nil, "delivery should fail")
+	testutil.Equals(t, "circuit breaker 'C100' is open", err.Error())
+	testutil.Equals(t, gobreaker.StateOpen, m.breaker("C100").State())
+	testutil.Equals(t, msnBreakerFailures, len(rtm.sent))
+}
+
+// Ensure that a channel whose messages are never acknowledged does not stop
+// the rest of the channels.
+func TestMessenger_breakerPerChannel(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+	m.backoffMin = time.Millisecond
+	m.ackTimeout = time.Millisecond * 10
+	m.retries = msnBreakerFailures + 2
+	rtm.onSend = func(msg *slack.OutgoingMessage) {
+		if msg.Channel != "C404" {
+			m.ack(msg.ID, "1000.01", nil)
+		}
+	}
+
+	d, err := m.Send(&OutgoingMessage{Channel: "C404", Text: "hi"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "circuit breaker 'C404' is open", d.Wait(context.Background()).Error())
+	testutil.Equals(t, gobreaker.StateOpen, m.breaker("C404").State())
+
+	d, err = m.Send(&OutgoingMessage{Channel: "C100", Text: "hi"})
+	testutil.Ok(t, err)
+	testutil.Ok(t, d.Wait(context.Background()))
+	testutil.Equals(t, gobreaker.StateClosed, m.breaker("C100").State())
+}
+
+// Ensure that the messages that could not be delivered before the messenger
+// was closed are posted by the next messenger and removed from the outbox.
+func TestMessenger_outbox(t *testing.T) {
+	db := NewTestDB()
+	defer db.Close()
+
+	// Slack is not acknowledging anything.
+	rtm := newFakeSlackRTMClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	first := InitMessenger(ctx, rtm, nil, db.DB, fastMessengerConfig)
+	for _, text := range []string{"foo", "bar"} {
+		testutil.Ok(t, send(first, &OutgoingMessage{Channel: "C100", Text: text}))
+	}
+	<-rtm.sent
+	cancel()
+	first.Close()
+
+	rtm = newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, db.DB, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+
+	_, lines := receiveLines(rtm, 2, time.Second*5)
+	testutil.Equals(t, []string{"foo", "bar"}, lines)
+
+	// The outbox is cleared once the messages are acknowledged.
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		var msgs []*OutboxMessage
+		testutil.Ok(t, db.View(func(tx *Tx) (err error) {
+			msgs, err = tx.OutboxMessages()
+			return err
+		}))
+		if len(msgs) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("outbox not cleared: %d messages left", len(msgs))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// Ensure that only the messages that failed for good are removed from the
+// outbox, the rest are kept to be posted again after the next start.
+func TestMessenger_outboxFailures(t *testing.T) {
+	db := NewTestDB()
+	defer db.Close()
+
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, db.DB, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+	m.backoffMin = time.Millisecond
+	m.ackTimeout = time.Millisecond * 10
+	rtm.onSend = func(msg *slack.OutgoingMessage) {
+		switch msg.Text {
+		case "ok":
+			m.ack(msg.ID, "1000.01", nil)
+		case "long":
+			m.ack(msg.ID, "", &slack.MessageTooLongEvent{Message: *msg, MaxLength: 1})
+		}
+		// Anything else is never acknowledged.
+	}
+
+	var ds []*Delivery
+	for i, text := range []string{"ok", "long", "lost"} {
+		d, err := m.Send(&OutgoingMessage{Channel: fmt.Sprintf("C%d", 100+i), Text: text})
+		testutil.Ok(t, err)
+		ds = append(ds, d)
+	}
+	for _, d := range ds {
+		d.Wait(context.Background())
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		var msgs []*OutboxMessage
+		testutil.Ok(t, db.View(func(tx *Tx) (err error) {
+			msgs, err = tx.OutboxMessages()
+			return err
+		}))
+		if len(msgs) == 1 {
+			testutil.Equals(t, "lost", msgs[0].Text)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("outbox not cleared: %d messages left", len(msgs))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// Ensure that the messages left in the outbox too long ago are dropped instead
+// of being posted.
+func TestMessenger_outboxMaxAge(t *testing.T) {
+	db := NewTestDB()
+	defer db.Close()
+	testutil.Ok(t, db.Update(func(tx *Tx) error {
+		if err := tx.SaveOutboxMessage(&OutboxMessage{Channel: "C100", Text: "old", Creation: time.Now().Add(-time.Hour)}); err != nil {
+			return err
+		}
+		return tx.SaveOutboxMessage(&OutboxMessage{Channel: "C100", Text: "new", Creation: time.Now()})
+	}))
+
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, db.DB, &MessengerConfig{Rate: 100, Burst: 10, ChannelRate: 100, ChannelBurst: 10, OutboxMaxAge: "30m"})
+	defer m.Close()
+	defer cancel()
+
+	_, lines := receiveLines(rtm, 1, time.Second*5)
+	testutil.Equals(t, []string{"new"}, lines)
+	_, lines = receiveLines(rtm, 1, msnPollWaitTime*2)
+	testutil.Equals(t, []string(nil), lines)
+	testutil.Ok(t, db.View(func(tx *Tx) error {
+		msgs, err := tx.OutboxMessages()
+		for _, om := range msgs {
+			testutil.Assert(t, om.Text != "old", "old message kept in the outbox")
+		}
+		return err
+	}))
+}
+
+// Ensure that the pending messages are delivered when the messenger is shut
+// down and that new messages are refused.
+func TestMessenger_Shutdown(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, &MessengerConfig{Rate: 100, Burst: 10, ChannelRate: 10, ChannelBurst: 1})
+	defer cancel()
+
+	var ds []*Delivery
+	for i := 0; i < 3; i++ {
+		d, err := m.Send(&OutgoingMessage{Channel: "C100", Text: "hi", ThreadTimestamp: fmt.Sprintf("100%d.01", i)})
+		testutil.Ok(t, err)
+		ds = append(ds, d)
+	}
+
+	ctx, done := context.WithTimeout(context.Background(), time.Second*5)
+	defer done()
+	testutil.Ok(t, m.Shutdown(ctx))
+	for _, d := range ds {
+		select {
+		case <-d.Done():
+			testutil.Ok(t, d.Err())
+		default:
+			t.Fatal("delivery should be resolved")
+		}
+	}
+
+	_, err := m.Send(&OutgoingMessage{Channel: "C100", Text: "hi"})
+	testutil.Equals(t, ErrMessengerClosed, err)
+}
+
+// Ensure that the default shutdown timeout is used when the configured one is
+// missing, not valid or not positive.
+func TestMessengerConfig_shutdownTimeout(t *testing.T) {
+	tests := []struct {
+		timeout string
+		want    time.Duration
+	}{
+		{"", msnShutdownTimeout},
+		{"soon", msnShutdownTimeout},
+		{"0s", msnShutdownTimeout},
+		{"-5s", msnShutdownTimeout},
+		{"2s", 2 * time.Second},
+	}
+	for _, tt := range tests {
+		c := &MessengerConfig{ShutdownTimeout: tt.timeout}
+		testutil.Equals(t, tt.want, c.shutdownTimeout())
+	}
+	testutil.Equals(t, msnShutdownTimeout, (*MessengerConfig)(nil).shutdownTimeout())
+}
+
+// Ensure that the shutdown gives up when the deadline is exceeded and that
+// the pending messages are kept in the outbox.
+func TestMessenger_ShutdownDeadline(t *testing.T) {
+	db := NewTestDB()
+	defer db.Close()
+
+	// Slack is not acknowledging anything.
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, db.DB, fastMessengerConfig)
+	defer cancel()
+	rtm.onSend = nil
+	testutil.Ok(t, send(m, &OutgoingMessage{Channel: "C100", Text: "hi"}))
+
+	ctx, done := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer done()
+	testutil.Equals(t, context.DeadlineExceeded, m.Shutdown(ctx))
+
+	testutil.Ok(t, db.View(func(tx *Tx) error {
+		msgs, err := tx.OutboxMessages()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(msgs))
+		return nil
+	}))
+}
@@ -0,0 +1,144 @@
+package qubot
+
+import (
+	"fmt"
+	"logger"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"golang.org/x/net/context"
+)
+
+// Middleware wraps a Handler to add some behaviour to its Handle method, e.g.
+// logging or access control. Middlewares are set with Qubot.Use, for all the
+// handlers, or with Qubot.HandleWith, for a single handler.
+type Middleware func(Handler) Handler
+
+// HandleFunc is the signature of the Handle method of handlers.
+type HandleFunc func(context.Context, Response, *Message)
+
+// WrapHandler returns a Handler that calls fn instead of the Handle method of
+// h. The rest of methods of the Handler interface are delegated to h. It is
+// meant to be used by middlewares, the optional interfaces of h, e.g.
+// HandlerMatcher, are checked by Qubot on h itself before the middlewares run.
+func WrapHandler(h Handler, fn HandleFunc) Handler {
+	return &wrappedHandler{Handler: h, fn: fn}
+}
+
+type wrappedHandler struct {
+	Handler
+	fn HandleFunc
+}
+
+func (h *wrappedHandler) Handle(ctx context.Context, r Response, msg *Message) {
+	h.fn(ctx, r, msg)
+}
+
+// Chain wraps the handler with the middlewares. The first middleware is the
+// outermost, i.e. it is the first one to get the message.
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Logging returns a middleware that logs the messages handled and the time
+// they took.
+func Logging() Middleware {
+	return func(h Handler) Handler {
+		name := handlerName(h)
+		return WrapHandler(h, func(ctx context.Context, r Response, msg *Message) {
+			id, _ := RequestID(ctx)
+			start := time.Now()
+			h.Handle(ctx, r, msg)
+			logger.Info("qubot", fmt.Sprintf("Handler %s", name), "request", id, "user", msg.User.ID, "channel", msg.Channel.ID, "duration", time.Since(start))
+		})
+	}
+}
+
+// AllowUsers returns a middleware that ignores the messages that are not sent
+// by one of the users given, identified by their IDs.
+func AllowUsers(ids ...string) Middleware {
+	allowed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		allowed[id] = true
+	}
+	return func(h Handler) Handler {
+		name := handlerName(h)
+		return WrapHandler(h, func(ctx context.Context, r Response, msg *Message) {
+			if !allowed[msg.User.ID] {
+				logger.Info("qubot", fmt.Sprintf("User not allowed by handler %s", name), "user", msg.User.ID)
+				return
+			}
+			h.Handle(ctx, r, msg)
+		})
+	}
+}
+
+// Throttle returns a middleware that limits the rate, in messages per second,
+// at which each user is served. The messages that exceed the limit are
+// dropped. The limit is shared by all the handlers that use the middleware.
+func Throttle(rate float64, burst int64) Middleware {
+	t := newThrottle(rate, burst)
+	return func(h Handler) Handler {
+		name := handlerName(h)
+		return WrapHandler(h, func(ctx context.Context, r Response, msg *Message) {
+			if !t.allow(msg.User.ID, time.Now()) {
+				logger.Debug("qubot", fmt.Sprintf("User throttled by handler %s", name), "user", msg.User.ID)
+				return
+			}
+			h.Handle(ctx, r, msg)
+		})
+	}
+}
+
+// throttle keeps a token bucket per user. A bucket that has not been used for
+// longer than it takes to fill it is full again, it is removed so the users
+// that come and go do not pile up.
+type throttle struct {
+	rate    float64
+	burst   int64
+	idle    time.Duration
+	buckets map[string]*userBucket
+	pruned  time.Time
+	mux     sync.Mutex
+}
+
+type userBucket struct {
+	tb   *ratelimit.Bucket
+	used time.Time
+}
+
+func newThrottle(rate float64, burst int64) *throttle {
+	return &throttle{
+		rate:    rate,
+		burst:   burst,
+		idle:    time.Duration(float64(burst) / rate * float64(time.Second)),
+		buckets: make(map[string]*userBucket),
+	}
+}
+
+// allow takes a token from the bucket of the user, now is the time of the
+// message. The idle buckets are looked for at most once per fill time.
+func (t *throttle) allow(user string, now time.Time) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if now.Sub(t.pruned) > t.idle {
+		for u, b := range t.buckets {
+			if now.Sub(b.used) > t.idle {
+				delete(t.buckets, u)
+			}
+		}
+		t.pruned = now
+	}
+	b, ok := t.buckets[user]
+	if !ok {
+		b = &userBucket{tb: ratelimit.NewBucketWithRate(t.rate, t.burst)}
+		t.buckets[user] = b
+	}
+	b.used = now
+	return b.tb.TakeAvailable(1) == 1
+}
@@ -0,0 +1,103 @@
+package qubot
+
+import (
+	"testing"
+	"time"
+
+	"testutil"
+
+	"golang.org/x/net/context"
+)
+
+// recordMiddleware returns a middleware that appends its name to calls when
+// it gets a message.
+func recordMiddleware(name string, calls *[]string) Middleware {
+	return func(h Handler) Handler {
+		return WrapHandler(h, func(ctx context.Context, r Response, msg *Message) {
+			*calls = append(*calls, name)
+			h.Handle(ctx, r, msg)
+		})
+	}
+}
+
+// Ensure that the middlewares are called in order and that the wrapped
+// handler keeps its name.
+func TestChain(t *testing.T) {
+	var calls []string
+	lh := &legacyTestHandler{}
+	h := Chain(AdaptHandler(lh), recordMiddleware("a", &calls), recordMiddleware("b", &calls))
+
+	res := NewResponse(&fakeMessenger{}, newTestMessage(""))
+	h.Handle(context.Background(), res, newTestMessage("hi"))
+	testutil.Equals(t, []string{"a", "b"}, calls)
+	testutil.Equals(t, []string{"hi"}, lh.handled)
+	testutil.Equals(t, "*qubot.legacyTestHandler", handlerName(h))
+}
+
+// Ensure that only the users allowed get through.
+func TestAllowUsers(t *testing.T) {
+	lh := &legacyTestHandler{}
+	h := AllowUsers("U200")(AdaptHandler(lh))
+	res := NewResponse(&fakeMessenger{}, newTestMessage(""))
+
+	h.Handle(context.Background(), res, newTestMessage("denied"))
+	msg := newTestMessage("allowed")
+	msg.User.ID = "U200"
+	h.Handle(context.Background(), res, msg)
+	testutil.Equals(t, []string{"allowed"}, lh.handled)
+}
+
+// Ensure that users are throttled independently.
+func TestThrottle(t *testing.T) {
+	lh := &legacyTestHandler{}
+	h := Throttle(0.001, 2)(AdaptHandler(lh))
+	res := NewResponse(&fakeMessenger{}, newTestMessage(""))
+
+	for _, text := range []string{"1", "2", "3"} {
+		h.Handle(context.Background(), res, newTestMessage(text))
+	}
+	msg := newTestMessage("other")
+	msg.User.ID = "U200"
+	h.Handle(context.Background(), res, msg)
+	testutil.Equals(t, []string{"1", "2", "other"}, lh.handled)
+}
+
+// Ensure that the buckets of the users that are gone are removed once they are
+// full again.
+func TestThrottle_prune(t *testing.T) {
+	th := newThrottle(1, 2)
+	now := time.Now()
+	testutil.Assert(t, th.allow("U100", now), "first message should be allowed")
+	testutil.Assert(t, th.allow("U200", now.Add(time.Second)), "first message should be allowed")
+	testutil.Equals(t, 2, len(th.buckets))
+
+	// Bob is still around when Alice's bucket is full again.
+	testutil.Assert(t, th.allow("U200", now.Add(2500*time.Millisecond)), "bob should be allowed")
+	testutil.Equals(t, 1, len(th.buckets))
+	_, ok := th.buckets["U200"]
+	testutil.Assert(t, ok, "bob's bucket should be kept")
+}
+
+// Ensure that global middlewares apply to the handlers registered before and
+// after Use, and that they go before the middlewares of the handler.
+func TestQubot_Use(t *testing.T) {
+	var calls []string
+	q := InitTestQubot()
+	before := &ctxHandler{ctxs: make(chan context.Context, 1)}
+	q.HandleWith(before, recordMiddleware("handler", &calls))
+	q.Use(recordMiddleware("global", &calls))
+	after := &ctxHandler{ctxs: make(chan context.Context, 1)}
+	q.Handle(after)
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	testRTM(q).events <- *newTestMessageEvent("C100", "hi")
+	for _, h := range []*ctxHandler{before, after} {
+		select {
+		case <-h.ctxs:
+		case <-time.After(time.Second * 5):
+			t.Fatal("message not handled")
+		}
+	}
+	testutil.Equals(t, []string{"global", "handler", "global"}, calls)
+}
@@ -1,48 +1,81 @@
 package qubot
 
 import (
+	"errors"
 	"fmt"
 	"logger"
-	"reflect"
+	"strconv"
 	"sync"
-	"time"
+	"sync/atomic"
 
-	"github.com/nlopes/slack"
 	"golang.org/x/net/context"
 )
 
+// ignoreUserList are the users that are always ignored, see FiltersConfig.
 var ignoreUserList = []string{"USLACKBOT"}
-var eventTimeout = time.Second * 10
+
+// ErrHandlerNotFound is returned when there is no handler registered with the
+// given name.
+var ErrHandlerNotFound = errors.New("qubot: handler not found")
 
 // Qubot at your service!
 type Qubot struct {
-	config   *Config
-	handlers []Handler
-	m        Messenger
-	db       *DB
-	client   slackClient
-	rtm      slackRTMClient
-
-	ctx    context.Context
-	cancel context.CancelFunc
-	wg     sync.WaitGroup
-	ready  chan struct{}
-	done   chan struct{}
-
-	me    *slack.User
-	users map[string]*slack.User
+	config *Config
+	a      Adapter
+	db     *DB
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	ready     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// stopping is closed by Shutdown to stop listening to the adapter,
+	// drained once the events received so far have been handled.
+	stopping chan struct{}
+	drained  chan struct{}
+	stopOnce sync.Once
+
+	// err is the reason why the service stopped on its own.
+	err  error
+	emux sync.Mutex
+
+	// handlers are launched by Start or, once Qubot has started, as soon as
+	// they are registered.
+	handlers   []*supervisedHandler
+	middleware []Middleware
+	started    bool
+	hmux       sync.RWMutex
+
+	// requests counts the messages handled, it is used to give them an ID.
+	requests uint64
 }
 
-// Init creates the Qubot object and returns a pointer to it.
+// Init creates the Qubot object, which runs on Slack, and returns a pointer
+// to it.
 func Init(config *Config) *Qubot {
+	q := newQubot(config)
+	q.a = newSlackAdapter(config, q.db, newSlackClient(config.Slack.Key))
+	return q
+}
+
+// InitWithAdapter creates a Qubot object that runs on the chat service of the
+// adapter given and returns a pointer to it.
+func InitWithAdapter(config *Config, a Adapter) *Qubot {
+	q := newQubot(config)
+	q.a = a
+	return q
+}
+
+func newQubot(config *Config) *Qubot {
 	q := Qubot{
-		config: config,
-		ready:  make(chan struct{}),
-		done:   make(chan struct{}),
-		users:  make(map[string]*slack.User),
+		config:   config,
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
+		stopping: make(chan struct{}),
+		drained:  make(chan struct{}),
 	}
-	q.client = newSlackClient(config.Slack.Key)
-	q.rtm = q.client.NewRTM()
 
 	q.db = &DB{}
 	err := q.db.Open(q.config.Database.Location, 0600)
@@ -56,14 +89,132 @@ func Init(config *Config) *Qubot {
 	return &q
 }
 
-// Handle registers a new Handler with Qubot.
+// Handle registers new handlers with Qubot. Handlers registered after Qubot
+// has started are started right away.
+//
+// Handlers are named after their type. When the same type is registered more
+// than once, a number is appended to the name, e.g. "*handlers.ping#2".
 func (q *Qubot) Handle(handlers ...Handler) {
+	q.hmux.Lock()
+	defer q.hmux.Unlock()
+
 	for _, h := range handlers {
-		q.handlers = append(q.handlers, h)
-		logger.Info("qubot", fmt.Sprintf("Registering handler %s", reflect.TypeOf(h)))
+		q.register(newSupervisedHandler(h))
 	}
 }
 
+// HandleWith registers a new handler with Qubot, the messages go through the
+// middlewares given before they reach the handler. See Handle.
+func (q *Qubot) HandleWith(h Handler, mws ...Middleware) {
+	q.hmux.Lock()
+	defer q.hmux.Unlock()
+
+	q.register(newSupervisedHandler(h, mws...))
+}
+
+// Use adds middlewares that apply to all the handlers, including the ones
+// already registered. They go before the middlewares set with HandleWith.
+func (q *Qubot) Use(mws ...Middleware) {
+	q.hmux.Lock()
+	defer q.hmux.Unlock()
+
+	q.middleware = append(q.middleware, mws...)
+	for _, sh := range q.handlers {
+		sh.use(q.middleware)
+	}
+}
+
+// register adds the handler to the list of handlers. The caller must hold
+// hmux.
+func (q *Qubot) register(sh *supervisedHandler) {
+	for n := 2; q.handler(sh.name) != nil; n++ {
+		sh.name = fmt.Sprintf("%s#%d", handlerName(sh.h), n)
+	}
+	sh.use(q.middleware)
+	q.handlers = append(q.handlers, sh)
+	logger.Info("qubot", fmt.Sprintf("Registering handler %s", sh.name))
+	if q.started {
+		q.launch(sh)
+	}
+}
+
+// RemoveHandler stops the handler and unregisters it.
+func (q *Qubot) RemoveHandler(name string) error {
+	q.hmux.Lock()
+	defer q.hmux.Unlock()
+
+	for i, sh := range q.handlers {
+		if sh.name == name {
+			sh.stop()
+			q.handlers = append(q.handlers[:i], q.handlers[i+1:]...)
+			logger.Info("qubot", fmt.Sprintf("Handler %s removed", name))
+			return nil
+		}
+	}
+	return ErrHandlerNotFound
+}
+
+// DisableHandler stops the handler, it does not get messages until it is
+// enabled again.
+func (q *Qubot) DisableHandler(name string) error {
+	q.hmux.Lock()
+	defer q.hmux.Unlock()
+
+	sh := q.handler(name)
+	if sh == nil {
+		return ErrHandlerNotFound
+	}
+	if !sh.isDisabled() {
+		sh.setDisabled(true)
+		sh.stop()
+		logger.Info("qubot", fmt.Sprintf("Handler %s disabled", name))
+	}
+	return nil
+}
+
+// EnableHandler starts a handler that was disabled. The restart count of the
+// handler is reset, so it can be used to give a failed handler another
+// chance too.
+func (q *Qubot) EnableHandler(name string) error {
+	q.hmux.Lock()
+	defer q.hmux.Unlock()
+
+	sh := q.handler(name)
+	if sh == nil {
+		return ErrHandlerNotFound
+	}
+	state := sh.State()
+	if state != HandlerDisabled && state != HandlerFailed {
+		return nil
+	}
+	sh.setDisabled(false)
+	logger.Info("qubot", fmt.Sprintf("Handler %s enabled", name))
+	if q.started {
+		q.launch(sh)
+	}
+	return nil
+}
+
+// handler returns the handler registered with the name or nil. The caller
+// must hold hmux.
+func (q *Qubot) handler(name string) *supervisedHandler {
+	for _, sh := range q.handlers {
+		if sh.name == name {
+			return sh
+		}
+	}
+	return nil
+}
+
+// launch starts the handler unless Qubot is closing. The caller must hold
+// hmux.
+func (q *Qubot) launch(sh *supervisedHandler) {
+	if q.ctx.Err() != nil || sh.isDisabled() {
+		return
+	}
+	sh.launch(q.ctx, &q.wg)
+}
+
 // Start the service without blocking.
 func (q *Qubot) Start() error {
 	// This is primarily for testing purposes, so we can verify from outside
@@ -72,31 +223,28 @@ func (q *Qubot) Start() error {
 		close(q.ready)
 	}()
 
-	// Connect to Slack.
-	err := q.connect()
+	// Connect to the chat service.
+	err := q.a.Connect(q.ctx)
 	if err != nil {
 		return err
 	}
+	logger.Info("qubot", "Connected", "adapter", q.a.Name())
 
-	// Initialize all the listeners that has been registered.
-	for _, h := range q.handlers {
-		q.wg.Add(1)
-		go func(h Handler) {
-			defer q.wg.Done()
-			err := h.Start(q.ctx)
-			if err != nil {
-				logger.Warn("qubot", fmt.Sprintf("Handler %s terminated", reflect.TypeOf(h)))
-			}
-		}(h)
+	// Initialize all the listeners that has been registered. They are
+	// restarted by their supervisor when they fail.
+	q.hmux.Lock()
+	q.started = true
+	for _, sh := range q.handlers {
+		q.launch(sh)
 	}
+	q.hmux.Unlock()
 
-	// Start messenger.
+	// The adapter is closed along with the service.
 	q.wg.Add(1)
 	go func() {
 		defer q.wg.Done()
-		q.m = InitMessenger(q.ctx, q.rtm)
 		<-q.ctx.Done()
-		q.m.Close()
+		q.a.Close()
 	}()
 
 	// Start event listener.
@@ -109,157 +257,196 @@ func (q *Qubot) Start() error {
 	return nil
 }
 
-func (q *Qubot) connect() error {
-	// Don't get too far until we validate our credentials.
-	resp, err := q.client.AuthTest()
-	if err != nil {
-		logger.Error("qubot", "Authentication request test failed")
-		return err
+// listenEvents passes the messages and events delivered by the adapter to
+// the dispatcher. They are handled by its pool of workers, in order for each
+// channel. When the service is shut down, the events already dispatched are
+// handled before the service is closed.
+func (q *Qubot) listenEvents() {
+	d := newDispatcher(q.config.Dispatcher, q.handleEvent)
+	d.start(q.ctx)
+	for {
+		select {
+		case event := <-q.a.Events():
+			if e, ok := event.(*ConnectionEvent); ok {
+				q.onConnectionEvent(e)
+			}
+			if err := d.dispatch(q.ctx, eventKey(event), event); err != nil {
+				logger.Debug("qubot", "Event dropped", "type", fmt.Sprintf("%T", event), "error", err)
+			}
+		case <-q.stopping:
+			q.discardEvents(d)
+			return
+		case <-q.ctx.Done():
+			d.wait()
+			return
+		}
 	}
-	logger.Info("qubot", "Authentication request test succeeded", "url", resp.URL)
+}
 
-	q.wg.Add(1)
+// discardEvents drains the dispatcher and signals it through drained. The
+// events delivered by the adapter are read and dropped until the service is
+// closed, the adapter may need to get them out of the way before it can
+// deliver the acknowledgements of the replies sent meanwhile.
+func (q *Qubot) discardEvents(d *dispatcher) {
+	drained := make(chan struct{})
 	go func() {
-		defer q.wg.Done()
-		// ManageConnection will exit sometime after q.rtm.Disconnect()
-		q.rtm.ManageConnection()
+		d.drain()
+		close(drained)
 	}()
-
-	return err
-}
-
-// listenEvents starts a new goroutine for each event received.
-func (q *Qubot) listenEvents() {
-	var wg sync.WaitGroup
-	c := make(chan error, 1)
 	for {
 		select {
-		case event := <-q.rtm.Events():
-			wg.Add(2)
-			go func() {
-				defer wg.Done()
-				go func() {
-					defer wg.Done()
-					defer func() {
-						if p := recover(); p != nil {
-							logger.Warn("qubot", "listenEvents", "Panic! Regained control.", p)
-						}
-					}()
-					c <- q.handleEvent(&event)
-				}()
-				// Await until one of the channels send.
-				select {
-				case <-c:
-				case <-time.After(eventTimeout):
-					return
-				}
-			}()
-		case err := <-c:
-			if err != nil {
-				logger.Warn("qubot", "listenEvents", "error", err)
-			}
+		case event := <-q.a.Events():
+			logger.Debug("qubot", "Event dropped", "type", fmt.Sprintf("%T", event), "error", "shutting down")
+		case <-drained:
+			close(q.drained)
+			drained = nil
 		case <-q.ctx.Done():
-			wg.Wait()
-			logger.Info("qubot", "Disconnecting from Slack RTM")
-			q.rtm.Disconnect()
+			if drained != nil {
+				<-drained
+			}
 			return
 		}
 	}
 }
 
-// handleEvents takes each type of event to its corresponding callback.
-// A full list of events can be found in the source code: https://goo.gl/ESCO4K.
-func (q *Qubot) handleEvent(event *slack.RTMEvent) error {
-	switch e := event.Data.(type) {
-	case *slack.ConnectingEvent:
-		logger.Debug("qubot", "Connection attempt", "count", e.Attempt)
-	case *slack.ConnectedEvent:
-		logger.Info("qubot", "Connected to Slack!")
-		return q.onConnectedEvent(e)
-	case *slack.HelloEvent:
-		logger.Info("qubot", "Slack sent greetings!")
-	case *slack.LatencyReport:
-		logger.Debug("qubot", "Latency report", "duration", e.Value)
-	case *slack.MessageEvent:
-		logger.Debug("qubot", "Message received")
-		return q.onMessageEvent(e)
-	case *slack.InvalidAuthEvent:
-		panic("Unrecoverable error: InvalidAuthEvent")
-	case *slack.RTMError:
-	case *slack.AckErrorEvent:
-	case *slack.ConnectionErrorEvent:
-	case *slack.DisconnectedEvent:
-	case *slack.MessageTooLongEvent:
-	case *slack.OutgoingErrorEvent:
-	default:
-		logger.Debug("qubot", "Unknown event received", "type", event.Type)
+// onConnectionEvent logs the changes of the state of the connection. When the
+// connection fails for good the service is shut down, see Err.
+func (q *Qubot) onConnectionEvent(e *ConnectionEvent) {
+	logger.Info("qubot", "Connection state changed", "adapter", q.a.Name(), "state", e.State, "error", e.Err)
+	if e.State != ConnectionFailed {
+		return
 	}
-	return nil
+	q.emux.Lock()
+	q.err = e.Err
+	q.emux.Unlock()
+	// Shutdown waits for the listener, it has to run on its own.
+	go q.Shutdown()
 }
 
-// onConnectedEvent retrieves information about the team and persist it.
-func (q *Qubot) onConnectedEvent(_ *slack.ConnectedEvent) error {
-	info := q.rtm.GetInfo()
-	for _, user := range info.Users {
-		if user.Name == q.config.Slack.Nickname {
-			q.me = &user
-			continue
+// eventKey returns the key used to dispatch an event, i.e. the channel where
+// it happened or the user that caused it.
+func eventKey(event interface{}) string {
+	switch e := event.(type) {
+	case *Message:
+		return e.Channel.ID
+	case Event:
+		user, channel := eventSource(e)
+		if channel != nil && channel.ID != "" {
+			return channel.ID
 		}
-		for _, iu := range ignoreUserList {
-			if user.Name == iu || user.ID == iu {
-				continue
-			}
-		}
-		if user.IsBot { // and user.Deleted?
-			continue
-		}
-		q.users[user.ID] = &user
-
-		// Persist user to the database
-		err := q.db.Update(func(tx *Tx) error {
-			u, err := tx.User(user.ID)
-			if err != nil {
-				return err
-			}
-			if u != nil {
-				return nil
-			}
-			return tx.SaveUser(&User{
-				ID:       user.ID,
-				Name:     user.Name,
-				Email:    user.Profile.Email,
-				Creation: time.Now(),
-			})
-		})
-		if err != nil {
-			logger.Error("qubot", "...", "error", err)
+		if user != nil {
+			return user.ID
 		}
 	}
+	return ""
+}
 
-	logger.Info("qubot", fmt.Sprintf("%d users have been identified (not incluing me or slackbot)", len(q.users)))
+// handleEvent takes the messages and the events to their handlers.
+func (q *Qubot) handleEvent(ctx context.Context, event interface{}) error {
+	switch e := event.(type) {
+	case *Message:
+		logger.Debug("qubot", "Message received")
+		return q.onMessage(ctx, e)
+	case Event:
+		return q.onEvent(q.withRequestID(ctx), e)
+	}
 	return nil
 }
 
-// onMessageEvent broadcasts incoming messages to handlers. Each handler runs
-// in a separate goroutine.
-func (q *Qubot) onMessageEvent(e *slack.MessageEvent) error {
-	for _, h := range q.handlers {
-		msg := NewMessage(&e.Msg)
-		r := NewResponse(q.m)
-		m, ok := h.(HandlerMatcher)
-		if ok && !m.Match(r, msg) {
-			continue
+// onMessage broadcasts incoming messages to handlers.
+func (q *Qubot) onMessage(ctx context.Context, msg *Message) error {
+	ctx = q.withRequestID(ctx)
+	var id, nickname string
+	me := q.a.Me()
+	if me != nil {
+		id, nickname = me.ID, me.Name
+	}
+	if q.config.Slack != nil && q.config.Slack.Nickname != "" {
+		nickname = q.config.Slack.Nickname
+	}
+
+	q.hmux.RLock()
+	handlers := make([]*supervisedHandler, len(q.handlers))
+	copy(handlers, q.handlers)
+	q.hmux.RUnlock()
+
+	if q.ignored(me, msg) {
+		logger.Debug("qubot", "Message ignored", "user", msg.User.ID, "channel", msg.Channel.ID)
+		return nil
+	}
+	msg.address(id, nickname)
+
+	for _, sh := range handlers {
+		// Don't bother the rest of handlers if we ran out of time.
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		h.Handle(r, msg)
+		// Each handler gets its own copy of the message.
+		msg := msg.copy()
+		sh.handle(ctx, NewResponse(q.a, msg), msg)
 	}
 	return nil
 }
 
-// Report makes Qubot log some vitals about the service.
-// Nothing serious here yet.
+// withRequestID returns a copy of the context that carries a new request ID.
+func (q *Qubot) withRequestID(ctx context.Context) context.Context {
+	return withRequestID(ctx, strconv.FormatUint(atomic.AddUint64(&q.requests, 1), 10))
+}
+
+// ignored returns true if the message must not reach the handlers because of
+// its sender or channel, see FiltersConfig. The messages sent by the bot,
+// identified by me, are always ignored to avoid echo loops. That includes
+// the ones posted with a custom username or icon, which Slack delivers as
+// bot_message carrying the bot ID instead of the user ID.
+func (q *Qubot) ignored(me *User, msg *Message) bool {
+	if me != nil {
+		if me.ID != "" && msg.User.ID == me.ID {
+			return true
+		}
+		if msg.IsBot && me.BotID != "" && msg.BotID == me.BotID {
+			return true
+		}
+	}
+	filters := q.config.Filters
+	if msg.User.ID != "" && filters.ignoreUser(msg.User.ID, msg.User.Name) {
+		return true
+	}
+	if msg.IsBot && filters.ignoreBot(msg.BotID, msg.BotName) {
+		return true
+	}
+	return filters.ignoreChannel(msg.Channel.ID, msg.Channel.Name)
+}
+
+// Report makes Qubot log some vitals about the service: the chat service and
+// the state of the handlers.
 func (q *Qubot) Report() {
-	info := q.rtm.GetInfo()
-	logger.Info("qubot", "Status report", "team", fmt.Sprintf("[%s] %s (%s)", info.Team.ID, info.Team.Name, info.Team.Domain))
+	logger.Info("qubot", "Status report", "adapter", q.a.Name(), "channels", len(q.a.Channels()))
+	for _, s := range q.Handlers() {
+		logger.Info("qubot", fmt.Sprintf("Handler %s", s.Name), "state", s.State, "restarts", s.Restarts, "error", s.Err)
+	}
+}
+
+// Channel returns the channel with the ID or the name given, e.g. "C024BE91L"
+// or "#general". The leading hash of the name is optional.
+func (q *Qubot) Channel(id string) (*Channel, bool) {
+	return q.a.Channel(id)
+}
+
+// Channels returns the channels known by Qubot sorted by name.
+func (q *Qubot) Channels() []*Channel {
+	return q.a.Channels()
+}
+
+// Handlers returns the status of the handlers registered with Qubot.
+func (q *Qubot) Handlers() []HandlerStatus {
+	q.hmux.RLock()
+	defer q.hmux.RUnlock()
+
+	statuses := make([]HandlerStatus, len(q.handlers))
+	for i, sh := range q.handlers {
+		statuses[i] = sh.status()
+	}
+	return statuses
 }
 
 // Done returns a channel that will be closed when the service is totally done.
@@ -269,9 +456,47 @@ func (q *Qubot) Done() chan struct{} {
 	return q.done
 }
 
+// Err returns the reason why the service stopped on its own, e.g.
+// ErrInvalidAuth, or nil.
+func (q *Qubot) Err() error {
+	q.emux.Lock()
+	defer q.emux.Unlock()
+	return q.err
+}
+
+// Shutdown stops the service gracefully. Qubot stops listening to the
+// adapter and the events received so far are handled, then the messenger
+// stops accepting new messages. It is given some time to deliver the pending
+// ones before the service is closed, see MessengerConfig.
+func (q *Qubot) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), q.config.Messenger.shutdownTimeout())
+	defer cancel()
+
+	q.stopOnce.Do(func() { close(q.stopping) })
+	q.hmux.RLock()
+	started := q.started
+	q.hmux.RUnlock()
+	if started {
+		logger.Info("qubot", "Handling pending events")
+		select {
+		case <-q.drained:
+		case <-ctx.Done():
+			logger.Warn("qubot", "Pending events could not be handled before the deadline")
+		}
+	}
+
+	logger.Info("qubot", "Delivering pending messages")
+	if err := q.a.Shutdown(ctx); err != nil {
+		logger.Warn("qubot", "Messenger shutdown", "error", err)
+	}
+	q.Close()
+}
+
 // Close shuts down the service cleanly.
 func (q *Qubot) Close() {
-	q.cancel()    // Emit cancellation signal.
-	q.wg.Wait()   // Wait until all the goroutines are done.
-	close(q.done) // Signal external receivers.
+	q.closeOnce.Do(func() {
+		q.cancel()    // Emit cancellation signal.
+		q.wg.Wait()   // Wait until all the goroutines are done.
+		close(q.done) // Signal external receivers.
+	})
 }
@@ -2,6 +2,8 @@ package qubot
 
 import (
 	"testing"
+	"time"
+
 	"testutil"
 
 	"github.com/nlopes/slack"
@@ -27,13 +29,12 @@ var testConfig = &Config{
 // a pointer to it.
 func InitTestQubot() *Qubot {
 	q := Qubot{
-		config: testConfig,
-		ready:  make(chan struct{}),
-		done:   make(chan struct{}),
-		users:  make(map[string]*slack.User),
+		config:   testConfig,
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
+		stopping: make(chan struct{}),
+		drained:  make(chan struct{}),
 	}
-	q.client = newFakeSlackClient()
-	q.rtm = q.client.NewRTM()
 
 	q.db = &DB{}
 	err := q.db.Open(testutil.Tempfile(), 0600)
@@ -41,11 +42,25 @@ func InitTestQubot() *Qubot {
 		panic(err)
 	}
 
+	s := newSlackAdapter(testConfig, q.db, newFakeSlackClient())
+	s.rtm.(*fakeSlackRTMClient).ackEvents()
+	q.a = s
+
 	root := context.Background()
 	q.ctx, q.cancel = context.WithCancel(root)
 	return &q
 }
 
+// testSlack returns the Slack adapter of a Qubot created by InitTestQubot.
+func testSlack(q *Qubot) *slackAdapter {
+	return q.a.(*slackAdapter)
+}
+
+// testRTM returns the fake RTM client of a Qubot created by InitTestQubot.
+func testRTM(q *Qubot) *fakeSlackRTMClient {
+	return testSlack(q).rtm.(*fakeSlackRTMClient)
+}
+
 // Ensures that Qubot starts properly.
 func TestQubot_Start(t *testing.T) {
 	q := InitTestQubot()
@@ -90,14 +105,259 @@ func TestQubot_Done(t *testing.T) {
 	testutil.Assert(t, closed == true, "closed should be true")
 }
 
-func TestQubot_connect(t *testing.T) {
+func TestSlackAdapter_Connect(t *testing.T) {
 	q := InitTestQubot()
-	client := q.client.(*fakeSlackClient)
-	rtm := q.rtm.(*fakeSlackRTMClient)
+	s := testSlack(q)
+	client := s.client.(*fakeSlackClient)
+	rtm := testRTM(q)
 	testutil.Assert(t, client.authTestCalled == false, "q.authTestCalled should be false")
-	testutil.Assert(t, rtm.manageConnectionCalled == false, "q.manageConnectionCalled should be false")
-	q.connect()
-	q.wg.Wait()
-	testutil.Assert(t, client.authTestCalled == true, "q.authTestCalled should be false")
-	testutil.Assert(t, rtm.manageConnectionCalled == true, "q.manageConnectionCalled should be true")
+	testutil.Ok(t, s.Connect(q.ctx))
+	testutil.Assert(t, rtm.waitConnections(1, time.Second), "ManageConnection should be called")
+	q.cancel()
+	s.Close()
+	testutil.Assert(t, client.authTestCalled == true, "q.authTestCalled should be true")
+}
+
+// Ensure that the pending messages are delivered before Qubot shuts down.
+func TestQubot_Shutdown(t *testing.T) {
+	q := InitTestQubot()
+	testutil.Ok(t, q.Start())
+	rtm := testRTM(q)
+	rtm.connect()
+
+	d, err := q.a.Send(&OutgoingMessage{Channel: "C100", Text: "bye"})
+	testutil.Ok(t, err)
+	q.Shutdown()
+	<-q.Done()
+
+	testutil.Ok(t, d.Err())
+	testutil.Equals(t, "bye", (<-rtm.sent).Text)
+}
+
+// gateHandler implements the Handler interface, it replies to the messages
+// once it is released.
+type gateHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *gateHandler) Start(ctx context.Context) error { return nil }
+
+func (h *gateHandler) Handle(ctx context.Context, r Response, msg *Message) {
+	h.started <- struct{}{}
+	<-h.release
+	r.Reply("done")
+}
+
+// Ensure that the replies sent while Qubot shuts down are acknowledged even
+// if the adapter keeps delivering events that nobody is going to handle.
+func TestQubot_ShutdownPendingEvents(t *testing.T) {
+	q := InitTestQubot()
+	h := &gateHandler{started: make(chan struct{}, 10), release: make(chan struct{})}
+	q.Handle(h)
+	testutil.Ok(t, q.Start())
+	rtm := testRTM(q)
+	rtm.connect()
+
+	rtm.events <- slack.RTMEvent{Data: &slack.MessageEvent{Msg: slack.Msg{Channel: "C100", User: "U100", Text: "hi"}}}
+	<-h.started
+
+	start := time.Now()
+	go q.Shutdown()
+	<-q.stopping
+	rtm.events <- slack.RTMEvent{Data: &slack.MessageEvent{Msg: slack.Msg{Channel: "C100", User: "U100", Text: "late"}}}
+	close(h.release)
+
+	select {
+	case <-q.Done():
+	case <-time.After(15 * time.Second):
+		t.Fatal("qubot did not shut down")
+	}
+	testutil.Assert(t, time.Since(start) < msnAckTimeout, "shutdown took %s", time.Since(start))
+	testutil.Equals(t, "done", (<-rtm.sent).Text)
+	testutil.Ok(t, q.db.View(func(tx *Tx) error {
+		msgs, err := tx.OutboxMessages()
+		testutil.Equals(t, 0, len(msgs))
+		return err
+	}))
+}
+
+// testInfo returns the team information of a fake team: the bot, Slackbot,
+// another bot and two users.
+func testInfo() *slack.Info {
+	info := &slack.Info{
+		User: &slack.UserDetails{ID: "U001", Name: "qubot"},
+		Users: []slack.User{
+			{ID: "U001", Name: "qubot", IsBot: true, Profile: slack.UserProfile{BotID: "B001"}},
+			{ID: "USLACKBOT", Name: "slackbot"},
+			{ID: "U002", Name: "jenkins", IsBot: true},
+			{ID: "U100", Name: "alice", Profile: slack.UserProfile{Email: "alice@example.com"}},
+			{ID: "U200", Name: "bob", Profile: slack.UserProfile{Email: "bob@example.com"}},
+		},
+	}
+	info.Channels = make([]slack.Channel, 2)
+	info.Channels[0].ID, info.Channels[0].Name = "C100", "general"
+	info.Channels[1].ID, info.Channels[1].Name = "C200", "random"
+	return info
+}
+
+// Ensure that the bot, Slackbot, other bots and ignored users are left out of
+// the directory of users.
+func TestSlackAdapter_onConnectedEvent(t *testing.T) {
+	q := InitTestQubot()
+	s := testSlack(q)
+	config := *testConfig
+	config.Filters = &FiltersConfig{Users: []string{"bob"}}
+	s.config = &config
+	testRTM(q).info = testInfo()
+
+	testutil.Ok(t, s.onConnectedEvent(&slack.ConnectedEvent{}))
+	testutil.Equals(t, "U001", s.Me().ID)
+	testutil.Equals(t, 1, len(s.users))
+	testutil.Equals(t, "alice@example.com", s.users["U100"].Email)
+
+	var u *User
+	testutil.Ok(t, q.db.View(func(tx *Tx) (err error) {
+		u, err = tx.User("U100")
+		return err
+	}))
+	testutil.Equals(t, "alice", u.Name)
+}
+
+// Ensure that the messages of ignored senders and channels, and the ones sent
+// by the bot itself, do not reach the handlers.
+func TestQubot_filters(t *testing.T) {
+	q := InitTestQubot()
+	config := *testConfig
+	config.Filters = &FiltersConfig{
+		Users:    []string{"U200"},
+		Bots:     []string{"B100"},
+		Channels: []string{"#random"},
+	}
+	q.config = &config
+	testSlack(q).config = &config
+	rtm := testRTM(q)
+	rtm.info = testInfo()
+	h := &msgHandler{msgs: make(chan *Message, 10)}
+	q.Handle(h)
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	rtm.events <- slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{}}
+	events := []slack.Msg{
+		{Channel: "C100", User: "U001", Text: "echo"},
+		{Channel: "C100", User: "USLACKBOT", Text: "slackbot"},
+		{Channel: "C100", User: "U200", Text: "bob"},
+		{Channel: "C100", SubType: "bot_message", BotID: "B001", Username: "custom", Text: "bot echo"},
+		{Channel: "C100", SubType: "bot_message", BotID: "B100", Text: "bot"},
+		{Channel: "C200", User: "U100", Text: "random"},
+		{Channel: "C100", SubType: "bot_message", BotID: "B200", Text: "other bot"},
+		{Channel: "C100", User: "U100", Text: "alice"},
+	}
+	for _, m := range events {
+		rtm.events <- slack.RTMEvent{Type: "message", Data: &slack.MessageEvent{Msg: m}}
+	}
+
+	var texts []string
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-h.msgs:
+			texts = append(texts, msg.Text)
+		case <-time.After(time.Second * 5):
+			t.Fatal("message not handled")
+		}
+	}
+	testutil.Equals(t, []string{"other bot", "alice"}, texts)
+}
+
+// Ensure that the directory of users follows the changes of the team.
+func TestSlackAdapter_userEvents(t *testing.T) {
+	q := InitTestQubot()
+	s := testSlack(q)
+	testRTM(q).info = testInfo()
+	testutil.Ok(t, s.onConnectedEvent(&slack.ConnectedEvent{}))
+
+	user := func(id string) (u *User) {
+		testutil.Ok(t, q.db.View(func(tx *Tx) (err error) {
+			u, err = tx.User(id)
+			return err
+		}))
+		return u
+	}
+	created := user("U100").Creation
+
+	events := []interface{}{
+		&slack.UserChangeEvent{User: slack.User{ID: "U100", Name: "alicia", RealName: "Alicia", TZ: "Europe/Madrid", IsAdmin: true, Profile: slack.UserProfile{Email: "alicia@example.com"}}},
+		&slack.TeamJoinEvent{User: slack.User{ID: "U300", Name: "carol"}},
+		&slack.UserChangeEvent{User: slack.User{ID: "U200", Name: "bob", Deleted: true}},
+		&slack.TeamJoinEvent{User: slack.User{ID: "U400", Name: "ci", IsBot: true}},
+	}
+	for _, e := range events {
+		testutil.Ok(t, s.handleEvent(context.Background(), &slack.RTMEvent{Data: e}))
+	}
+
+	u := user("U100")
+	testutil.Equals(t, &User{ID: "U100", Name: "alicia", RealName: "Alicia", Email: "alicia@example.com", TimeZone: "Europe/Madrid", IsAdmin: true, Creation: created}, u)
+	testutil.Equals(t, "alicia", s.User("U100").Name)
+	testutil.Equals(t, "carol", s.User("U300").Name)
+	testutil.Assert(t, user("U200").Deleted, "bob should be deleted")
+	_, ok := s.users["U200"]
+	testutil.Assert(t, !ok, "bob should not be cached")
+	testutil.Assert(t, user("U400") == nil, "bots should not be saved")
+}
+
+// Ensure that the channels follow the changes of the team.
+func TestQubot_channelEvents(t *testing.T) {
+	q := InitTestQubot()
+	s := testSlack(q)
+	testRTM(q).info = testInfo()
+	testutil.Ok(t, s.onConnectedEvent(&slack.ConnectedEvent{}))
+
+	// Nobody else reads the messages delivered by the adapter.
+	go func() {
+		for {
+			select {
+			case <-s.Events():
+			case <-q.ctx.Done():
+				return
+			}
+		}
+	}()
+	defer q.cancel()
+
+	joined := slack.Channel{}
+	joined.ID, joined.Name, joined.Members = "C300", "dev", []string{"U100"}
+	events := []interface{}{
+		&slack.ChannelCreatedEvent{Channel: slack.ChannelCreatedInfo{ID: "C300", Name: "dev"}},
+		&slack.ChannelJoinedEvent{Channel: joined},
+		&slack.ChannelRenameEvent{Channel: slack.ChannelRenameInfo{ID: "C200", Name: "off-topic"}},
+		&slack.ChannelArchiveEvent{Channel: "C100"},
+		&slack.MessageEvent{Msg: slack.Msg{Channel: "C300", SubType: "channel_join", User: "U200"}},
+		&slack.MessageEvent{Msg: slack.Msg{Channel: "C300", SubType: "channel_topic", User: "U200", Topic: "Builds"}},
+	}
+	for _, e := range events {
+		testutil.Ok(t, s.handleEvent(q.ctx, &slack.RTMEvent{Data: e}))
+	}
+
+	c, ok := q.Channel("#dev")
+	testutil.Assert(t, ok, "channel should be found by name")
+	testutil.Equals(t, "C300", c.ID)
+	testutil.Assert(t, c.IsMember, "bot should be a member")
+	testutil.Equals(t, []string{"U100", "U200"}, c.Members)
+	testutil.Equals(t, "Builds", c.Topic)
+	c, _ = q.Channel("C100")
+	testutil.Assert(t, c.Archived, "channel should be archived")
+
+	var names []string
+	for _, c := range q.Channels() {
+		names = append(names, c.Name)
+	}
+	testutil.Equals(t, []string{"dev", "general", "off-topic"}, names)
+
+	// The channels are kept in the database.
+	testutil.Ok(t, q.db.View(func(tx *Tx) error {
+		c, err := tx.Channel("C200")
+		testutil.Equals(t, "off-topic", c.Name)
+		return err
+	}))
 }
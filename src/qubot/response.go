@@ -1,27 +1,166 @@
 package qubot
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 )
 
-// A Response interface is used by a handler to construct a response.
+// A Response interface is used by a handler to construct a response. The
+// replies are addressed to the channel, user and thread of the message that is
+// being handled.
 type Response interface {
-	Write(io.Reader)
+	// Write replies with the contents of the reader.
+	Write(io.Reader) error
+
+	// Reply posts a message in the channel of the original message. If the
+	// original message was part of a thread the reply is posted there too.
+	Reply(text string) error
+	Replyf(format string, a ...interface{}) error
+
+	// ReplyInThread posts a message in the thread of the original message,
+	// starting a new thread when needed.
+	ReplyInThread(text string) error
+	ReplyInThreadf(format string, a ...interface{}) error
+
+	// DirectMessage sends a private message to the author of the original
+	// message.
+	DirectMessage(text string) error
+	DirectMessagef(format string, a ...interface{}) error
+
+	// Send posts a message with the features that plain replies lack, e.g.
+	// attachments. The message goes to the channel and thread of the
+	// original message unless it sets its own channel.
+	Send(msg *OutgoingMessage) error
+
+	// React adds a reaction to the original message, name is the name of
+	// an emoji without colons. The messenger has to be an Editor.
+	React(name string) error
 }
 
-// response
+// errNoChannel is returned when replying to an event that happened nowhere,
+// e.g. a change of the connection.
+var errNoChannel = errors.New("response: no channel to reply to")
+
+// response implements the Response interface, the messages are delivered by
+// the Messenger.
 type response struct {
-	msn  Messenger
-	text []byte
+	msn     Messenger
+	channel string
+	user    string
+	thread  string
+	ts      string
+}
+
+// NewResponse returns a new response to the given message.
+func NewResponse(msn Messenger, msg *Message) Response {
+	return newResponse(msn, msg.Channel.ID, msg.User.ID, msg.ThreadTimestamp, msg.Timestamp)
+}
+
+// newResponse returns a Response that replies in the channel and thread
+// given. The channel can be a user ID, see Messenger. Without a channel
+// nothing can be sent, see errNoChannel.
+func newResponse(msn Messenger, channel, user, thread, ts string) Response {
+	return &response{
+		msn:     msn,
+		channel: channel,
+		user:    user,
+		thread:  thread,
+		ts:      ts,
+	}
+}
+
+func (r *response) Write(reader io.Reader) error {
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return r.Reply(string(b))
+}
+
+func (r *response) Reply(text string) error {
+	return r.send(r.channel, r.thread, text)
+}
+
+func (r *response) Replyf(format string, a ...interface{}) error {
+	return r.Reply(fmt.Sprintf(format, a...))
+}
+
+func (r *response) ReplyInThread(text string) error {
+	thread := r.thread
+	if thread == "" {
+		thread = r.ts
+	}
+	return r.send(r.channel, thread, text)
+}
+
+func (r *response) ReplyInThreadf(format string, a ...interface{}) error {
+	return r.ReplyInThread(fmt.Sprintf(format, a...))
+}
+
+func (r *response) DirectMessage(text string) error {
+	if isIMChannel(r.channel) {
+		return r.send(r.channel, "", text)
+	}
+	// The messenger resolves the user ID to the ID of the IM channel.
+	return r.send(r.user, "", text)
+}
+
+func (r *response) DirectMessagef(format string, a ...interface{}) error {
+	return r.DirectMessage(fmt.Sprintf(format, a...))
+}
+
+func (r *response) Send(msg *OutgoingMessage) error {
+	out := *msg
+	if out.Channel == "" {
+		out.Channel = r.channel
+		if out.ThreadTimestamp == "" {
+			out.ThreadTimestamp = r.thread
+		}
+	}
+	if out.Channel == "" {
+		return errNoChannel
+	}
+	if r.msn == nil {
+		return fmt.Errorf("response: messenger not available")
+	}
+	_, err := r.msn.Send(&out)
+	return err
+}
+
+func (r *response) React(name string) error {
+	e, ok := r.msn.(Editor)
+	if !ok {
+		return fmt.Errorf("response: reactions not supported")
+	}
+	if r.ts == "" {
+		return fmt.Errorf("response: no message to react to")
+	}
+	return e.React(r.channel, r.ts, name)
+}
+
+func (r *response) send(channel, thread, text string) error {
+	if channel == "" {
+		return errNoChannel
+	}
+	if r.msn == nil {
+		return fmt.Errorf("response: messenger not available")
+	}
+	_, err := r.msn.Send(&OutgoingMessage{
+		Channel:         channel,
+		ThreadTimestamp: thread,
+		Text:            text,
+	})
+	return err
 }
 
-// NewResponse returns a new response.
-func NewResponse(msn Messenger) Response {
-	r := response{msn, make([]byte, 100)}
-	return &r
+// isIMChannel reports whether the ID belongs to a direct message channel.
+func isIMChannel(id string) bool {
+	return len(id) > 0 && id[0] == 'D'
 }
 
-func (r *response) Write(reader io.Reader) {
-	fmt.Println(reader)
+// isUserID reports whether the ID belongs to a user.
+func isUserID(id string) bool {
+	return len(id) > 0 && (id[0] == 'U' || id[0] == 'W')
 }
@@ -0,0 +1,163 @@
+package qubot
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"testutil"
+
+	"github.com/nlopes/slack"
+	"golang.org/x/net/context"
+)
+
+// fakeMessenger implements the Messenger interface and keeps the messages
+// that have been sent.
+type fakeMessenger struct {
+	mu   sync.Mutex
+	sent []*OutgoingMessage
+}
+
+func (m *fakeMessenger) Send(msg *OutgoingMessage) (*Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	d := newDelivery()
+	d.resolve("", nil)
+	return d, nil
+}
+
+func (m *fakeMessenger) Shutdown(ctx context.Context) error { return nil }
+
+func (m *fakeMessenger) Close() {}
+
+func (m *fakeMessenger) texts() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var texts []string
+	for _, msg := range m.sent {
+		texts = append(texts, msg.Text)
+	}
+	return texts
+}
+
+func newTestMessage(text string) *Message {
+	return newMessage(&slack.Msg{Channel: "C100", User: "U100", Timestamp: "1000.01", Text: text}, nil)
+}
+
+// replyHandler implements the Handler interface and replies to every message.
+type replyHandler struct{}
+
+func (h *replyHandler) Start(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (h *replyHandler) Handle(ctx context.Context, r Response, msg *Message) {
+	r.Replyf("You said: %s", msg.RawText)
+}
+
+// Ensure that the replies are addressed to the channel and thread of the
+// original message.
+func TestResponse_Reply(t *testing.T) {
+	msn := &fakeMessenger{}
+	msg := newTestMessage("hi")
+	r := NewResponse(msn, msg)
+
+	testutil.Ok(t, r.Reply("hello"))
+	testutil.Ok(t, r.ReplyInThreadf("hello %s", "again"))
+	testutil.Equals(t, []*OutgoingMessage{
+		{Channel: "C100", Text: "hello"},
+		{Channel: "C100", Text: "hello again", ThreadTimestamp: "1000.01"},
+	}, msn.sent)
+
+	// Replies to a message posted in a thread stay in the thread.
+	msn = &fakeMessenger{}
+	msg.ThreadTimestamp = "999.01"
+	r = NewResponse(msn, msg)
+	testutil.Ok(t, r.Reply("hello"))
+	testutil.Ok(t, r.ReplyInThread("hello"))
+	testutil.Equals(t, "999.01", msn.sent[0].ThreadTimestamp)
+	testutil.Equals(t, "999.01", msn.sent[1].ThreadTimestamp)
+}
+
+// Ensure that rich messages go to the channel and thread of the original
+// message unless they set their own channel, and that reactions need an
+// Editor.
+func TestResponse_Send(t *testing.T) {
+	msn := &fakeMessenger{}
+	msg := newTestMessage("hi")
+	msg.ThreadTimestamp = "999.01"
+	r := NewResponse(msn, msg)
+
+	attachments := []Attachment{{Fallback: "card"}}
+	testutil.Ok(t, r.Send(&OutgoingMessage{Text: "hello", Attachments: attachments}))
+	testutil.Ok(t, r.Send(&OutgoingMessage{Channel: "C200", Text: "hello"}))
+	testutil.Equals(t, []*OutgoingMessage{
+		{Channel: "C100", Text: "hello", ThreadTimestamp: "999.01", Attachments: attachments},
+		{Channel: "C200", Text: "hello"},
+	}, msn.sent)
+
+	testutil.Assert(t, r.React("eyes") != nil, "fakeMessenger can not react")
+}
+
+// Ensure that nothing is sent when there is no channel to reply to, e.g. in
+// response to a change of the connection.
+func TestResponse_noChannel(t *testing.T) {
+	msn := &fakeMessenger{}
+	r := newResponse(msn, "", "", "", "")
+
+	testutil.Equals(t, errNoChannel, r.Reply("hello"))
+	testutil.Equals(t, errNoChannel, r.ReplyInThread("hello"))
+	testutil.Equals(t, errNoChannel, r.DirectMessage("hello"))
+	testutil.Equals(t, errNoChannel, r.Send(&OutgoingMessage{Text: "hello"}))
+	testutil.Ok(t, r.Send(&OutgoingMessage{Channel: "C200", Text: "hello"}))
+	testutil.Equals(t, []*OutgoingMessage{{Channel: "C200", Text: "hello"}}, msn.sent)
+}
+
+// Ensure that direct messages are delivered to the IM channel of the author.
+func TestResponse_DirectMessage(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	rtm.info = &slack.Info{IMs: []slack.IM{{User: "U100"}}}
+	rtm.info.IMs[0].ID = "D200"
+	m, cancel := newTestMessenger(rtm, nil, nil)
+	defer m.Close()
+	defer cancel()
+
+	testutil.Ok(t, NewResponse(m, newTestMessage("hi")).DirectMessagef("psst %d", 1))
+	testutil.Ok(t, NewResponse(m, newMessage(&slack.Msg{Channel: "C100", User: "U300"}, nil)).DirectMessage("psst"))
+
+	// Each channel has its own queue so the delivery order is not known.
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-rtm.sent:
+			got[msg.Channel] = true
+		case <-time.After(time.Second * 5):
+			t.Fatal("message not sent")
+		}
+	}
+	testutil.Equals(t, map[string]bool{"D200": true, "D300": true}, got)
+}
+
+// Ensure that a handler can reply to a message received from Slack.
+func TestResponse_roundTrip(t *testing.T) {
+	q := InitTestQubot()
+	q.Handle(&replyHandler{})
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	rtm := testRTM(q)
+	rtm.connect()
+	rtm.events <- slack.RTMEvent{Data: &slack.MessageEvent{
+		Msg: slack.Msg{Channel: "C100", User: "U100", Text: "hi"},
+	}}
+
+	select {
+	case msg := <-rtm.sent:
+		testutil.Equals(t, "C100", msg.Channel)
+		testutil.Equals(t, "You said: hi", msg.Text)
+	case <-time.After(time.Second * 5):
+		t.Fatal("reply not sent")
+	}
+}
@@ -0,0 +1,327 @@
+package qubot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/context"
+)
+
+// A CommandFunc is called by the Router when a message matches one of its
+// commands and the arguments could be parsed. The context is the one given to
+// the Handle method of the Router.
+type CommandFunc func(context.Context, Response, *Message, *Args)
+
+// Router is a Handler helper that dispatches messages to commands. Commands
+// are declared with a pattern made of literal words and arguments, e.g.:
+//
+//	issue <id:int> [comment:rest]
+//
+// Required arguments are enclosed in angle brackets, optional arguments in
+// square brackets. The type of the argument follows the colon and it defaults
+// to string when omitted. Supported types are:
+//
+//	string  a single word
+//	int     a decimal integer
+//	rest    the remaining text of the message, it must be the last argument
+//
+// The commands are matched against the text of the message without the
+// address of the bot, so "qubot: ping" matches the command "ping".
+//
+// Router implements the Handle and Match methods so handlers can embed it and
+// only provide their own Start method.
+type Router struct {
+	commands  []*command
+	addressed bool
+}
+
+// NewRouter returns a new Router.
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// RequireAddress makes the router ignore the messages that are not addressed
+// to the bot, see Message.Addressed.
+func (r *Router) RequireAddress() {
+	r.addressed = true
+}
+
+// AddressedOnly implements the AddressedHandler interface.
+func (r *Router) AddressedOnly() bool {
+	return r.addressed
+}
+
+// Command registers a new command. It panics if the pattern is not valid.
+func (r *Router) Command(pattern string, fn CommandFunc) {
+	if fn == nil {
+		panic("nil command func")
+	}
+	c, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	c.fn = fn
+	r.commands = append(r.commands, c)
+}
+
+// Match implements the HandlerMatcher interface. It reports whether the
+// message starts with the literal words of any of the registered commands and
+// their arguments can be parsed. When the message is addressed to the bot the
+// arguments do not need to be right, the user gets the usage of the commands.
+// Edited and deleted messages never match, their commands already ran.
+func (r *Router) Match(_ Response, msg *Message) bool {
+	if msg.Edited || msg.Deleted {
+		return false
+	}
+	cmds := r.lookup(msg.Text)
+	if len(cmds) == 0 || msg.Addressed() {
+		return len(cmds) > 0
+	}
+	for _, c := range cmds {
+		if _, err := c.parse(msg.Text); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle implements the Handler interface. The first command that matches
+// the message and whose arguments can be parsed is executed, otherwise the
+// user is replied with the usage of the commands that matched, as long as the
+// message is addressed to the bot. The messages that just happen to start
+// with the words of a command are not replied.
+func (r *Router) Handle(ctx context.Context, res Response, msg *Message) {
+	cmds := r.lookup(msg.Text)
+	if len(cmds) == 0 {
+		return
+	}
+
+	var perr error
+	for _, c := range cmds {
+		args, err := c.parse(msg.Text)
+		if err != nil {
+			if perr == nil {
+				perr = err
+			}
+			continue
+		}
+		c.fn(ctx, res, msg, args)
+		return
+	}
+	if !msg.Addressed() {
+		return
+	}
+
+	usage := make([]string, len(cmds))
+	for i, c := range cmds {
+		usage[i] = c.pattern
+	}
+	res.Replyf("%s\nUsage: %s", perr, strings.Join(usage, " | "))
+}
+
+// lookup returns the commands whose literal words prefix the text.
+func (r *Router) lookup(text string) []*command {
+	toks := tokenize(text)
+	var cmds []*command
+	for _, c := range r.commands {
+		if c.matchLiterals(toks) {
+			cmds = append(cmds, c)
+		}
+	}
+	return cmds
+}
+
+// Args holds the arguments parsed by the Router.
+type Args struct {
+	values map[string]interface{}
+}
+
+// Has reports whether the argument was given.
+func (a *Args) Has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+// String returns the value of a string or rest argument, or the empty string
+// if it was not given.
+func (a *Args) String(name string) string {
+	s, _ := a.values[name].(string)
+	return s
+}
+
+// Int returns the value of an int argument, or zero if it was not given.
+func (a *Args) Int(name string) int {
+	i, _ := a.values[name].(int)
+	return i
+}
+
+type paramKind int
+
+const (
+	literalParam paramKind = iota
+	stringParam
+	intParam
+	restParam
+)
+
+type param struct {
+	name     string
+	kind     paramKind
+	optional bool
+}
+
+func (p param) String() string {
+	if p.kind == literalParam {
+		return p.name
+	}
+	var kind string
+	switch p.kind {
+	case intParam:
+		kind = "int"
+	case restParam:
+		kind = "rest"
+	default:
+		kind = "string"
+	}
+	if p.optional {
+		return fmt.Sprintf("[%s:%s]", p.name, kind)
+	}
+	return fmt.Sprintf("<%s:%s>", p.name, kind)
+}
+
+// command is a pattern registered with the Router.
+type command struct {
+	pattern  string
+	literals int // number of leading literal words
+	params   []param
+	fn       CommandFunc
+}
+
+// parsePattern turns a command pattern into a command.
+func parsePattern(pattern string) (*command, error) {
+	c := &command{pattern: strings.Join(strings.Fields(pattern), " ")}
+	var optional, rest bool
+	for _, tok := range strings.Fields(pattern) {
+		if rest {
+			return nil, fmt.Errorf("router: %q: rest argument must be the last one", pattern)
+		}
+		var p param
+		switch {
+		case strings.HasPrefix(tok, "<") && strings.HasSuffix(tok, ">"):
+			if optional {
+				return nil, fmt.Errorf("router: %q: required argument %s follows an optional one", pattern, tok)
+			}
+		case strings.HasPrefix(tok, "[") && strings.HasSuffix(tok, "]"):
+			p.optional = true
+			optional = true
+		default:
+			if len(c.params) > c.literals {
+				return nil, fmt.Errorf("router: %q: literal %q follows an argument", pattern, tok)
+			}
+			c.params = append(c.params, param{name: strings.ToLower(tok), kind: literalParam})
+			c.literals++
+			continue
+		}
+		name, kind := tok[1:len(tok)-1], "string"
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, kind = name[:i], name[i+1:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("router: %q: argument %s has no name", pattern, tok)
+		}
+		p.name = name
+		switch kind {
+		case "string":
+			p.kind = stringParam
+		case "int":
+			p.kind = intParam
+		case "rest":
+			p.kind = restParam
+			rest = true
+		default:
+			return nil, fmt.Errorf("router: %q: unknown type %q", pattern, kind)
+		}
+		c.params = append(c.params, p)
+	}
+	if c.literals == 0 {
+		return nil, fmt.Errorf("router: %q: pattern must start with a literal word", pattern)
+	}
+	return c, nil
+}
+
+// matchLiterals reports whether the tokens start with the literal words of the
+// command. The comparison is case insensitive.
+func (c *command) matchLiterals(toks []token) bool {
+	if len(toks) < c.literals {
+		return false
+	}
+	for i := 0; i < c.literals; i++ {
+		if strings.ToLower(toks[i].text) != c.params[i].name {
+			return false
+		}
+	}
+	return true
+}
+
+// parse extracts the arguments of the command from the text.
+func (c *command) parse(text string) (*Args, error) {
+	toks := tokenize(text)
+	args := &Args{values: make(map[string]interface{})}
+	i := c.literals
+	for _, p := range c.params[c.literals:] {
+		if i >= len(toks) {
+			if !p.optional {
+				return nil, fmt.Errorf("Missing argument %s", p)
+			}
+			break
+		}
+		switch p.kind {
+		case restParam:
+			args.values[p.name] = strings.TrimSpace(text[toks[i].pos:])
+			return args, nil
+		case intParam:
+			v, err := strconv.Atoi(toks[i].text)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value %q for %s", toks[i].text, p)
+			}
+			args.values[p.name] = v
+		default:
+			args.values[p.name] = toks[i].text
+		}
+		i++
+	}
+	if i < len(toks) {
+		return nil, fmt.Errorf("Unexpected argument %q", toks[i].text)
+	}
+	return args, nil
+}
+
+// token is a word found in the text of a message and its byte offset.
+type token struct {
+	text string
+	pos  int
+}
+
+// tokenize splits the text in words separated by white space.
+func tokenize(text string) []token {
+	var toks []token
+	start := -1
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				toks = append(toks, token{text[start:i], start})
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		toks = append(toks, token{text[start:], start})
+	}
+	return toks
+}
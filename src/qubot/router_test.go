@@ -0,0 +1,99 @@
+package qubot
+
+import (
+	"testing"
+
+	"testutil"
+
+	"golang.org/x/net/context"
+)
+
+// Ensure that the router parses typed and optional arguments.
+func TestRouter_Handle(t *testing.T) {
+	var got *Args
+	r := NewRouter()
+	r.Command("issue <id:int> [comment:rest]", func(_ context.Context, _ Response, _ *Message, args *Args) {
+		got = args
+	})
+
+	msn := &fakeMessenger{}
+	msg := newTestMessage("Issue 1234  this is   a comment ")
+	res := NewResponse(msn, msg)
+	testutil.Assert(t, r.Match(res, msg), "router should match")
+	r.Handle(context.Background(), res, msg)
+	testutil.Assert(t, got != nil, "command func should be called")
+	testutil.Equals(t, 1234, got.Int("id"))
+	testutil.Equals(t, "this is   a comment", got.String("comment"))
+
+	got = nil
+	r.Handle(context.Background(), res, newTestMessage("issue 10"))
+	testutil.Assert(t, got != nil, "command func should be called")
+	testutil.Equals(t, 10, got.Int("id"))
+	testutil.Assert(t, !got.Has("comment"), "comment should not be given")
+	testutil.Equals(t, 0, len(msn.texts()))
+}
+
+// Ensure that the router replies with the usage when the arguments are wrong
+// and the message is addressed to the bot.
+func TestRouter_Usage(t *testing.T) {
+	r := NewRouter()
+	r.Command("issue <id:int>", func(_ context.Context, _ Response, _ *Message, _ *Args) {
+		t.Fatal("command func should not be called")
+	})
+
+	tests := []struct {
+		text string
+		exp  string
+	}{
+		{"issue", "Missing argument <id:int>\nUsage: issue <id:int>"},
+		{"issue abc", "Invalid value \"abc\" for <id:int>\nUsage: issue <id:int>"},
+		{"issue 1 2", "Unexpected argument \"2\"\nUsage: issue <id:int>"},
+	}
+	for _, tt := range tests {
+		msn := &fakeMessenger{}
+		msg := newTestMessage(tt.text)
+		msg.IsPrefixed = true
+		r.Handle(context.Background(), NewResponse(msn, msg), msg)
+		testutil.Equals(t, []string{tt.exp}, msn.texts())
+	}
+
+	// Someone talking about issues in a channel is not replied.
+	msn := &fakeMessenger{}
+	msg := newTestMessage("issue tracker is down")
+	r.Handle(context.Background(), NewResponse(msn, msg), msg)
+	testutil.Equals(t, 0, len(msn.texts()))
+}
+
+// Ensure that the router only matches the literal words of its commands.
+func TestRouter_Match(t *testing.T) {
+	r := NewRouter()
+	r.Command("issue list [project]", func(_ context.Context, _ Response, _ *Message, _ *Args) {})
+
+	res := NewResponse(&fakeMessenger{}, newTestMessage(""))
+	testutil.Assert(t, r.Match(res, newTestMessage("issue list qubot")), "router should match")
+	testutil.Assert(t, !r.Match(res, newTestMessage("issue")), "router should not match")
+	testutil.Assert(t, !r.Match(res, newTestMessage("issues list")), "router should not match")
+	testutil.Assert(t, !r.Match(res, newTestMessage("")), "router should not match")
+
+	// Wrong arguments only match the messages addressed to the bot, which
+	// are replied with the usage.
+	msg := newTestMessage("issue list qubot now")
+	testutil.Assert(t, !r.Match(res, msg), "router should not match")
+	msg.IsDirect = true
+	testutil.Assert(t, r.Match(res, msg), "router should match")
+}
+
+// Ensure that invalid patterns are rejected.
+func TestParsePattern(t *testing.T) {
+	for _, p := range []string{
+		"<id:int>",
+		"issue [id:int] <comment>",
+		"issue <comment:rest> <id:int>",
+		"issue <id:float>",
+		"issue <:int>",
+		"issue <id> show",
+	} {
+		_, err := parsePattern(p)
+		testutil.Assert(t, err != nil, "pattern %q should be invalid", p)
+	}
+}
@@ -0,0 +1,191 @@
+package qubot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// Default names of the fake user and channel of the shell adapter.
+const (
+	shellUser    = "shell"
+	shellChannel = "shell"
+	shellBot     = "qubot"
+)
+
+// ShellAdapter implements the Adapter interface for a terminal, it is meant to
+// try the handlers locally without a chat service. Every line read is a
+// message sent by a fake user to a fake channel, see ShellConfig, and the
+// replies of the bot are written to the output. Direct messages are marked as
+// such and attachments are shown by their fallback text.
+type ShellAdapter struct {
+	r      io.Reader
+	w      io.Writer
+	wmux   sync.Mutex
+	events chan interface{}
+	done   chan struct{}
+	seq    int64
+
+	me      *User
+	user    *User
+	channel *Channel
+}
+
+// NewShellAdapter returns a new ShellAdapter that reads the messages from r and
+// writes the replies to w. The bot is named after the nickname of the Slack
+// configuration when it is given.
+func NewShellAdapter(config *Config, r io.Reader, w io.Writer) *ShellAdapter {
+	user, channel, bot := shellUser, shellChannel, shellBot
+	if config.Shell != nil {
+		if config.Shell.User != "" {
+			user = config.Shell.User
+		}
+		if config.Shell.Channel != "" {
+			channel = strings.TrimPrefix(config.Shell.Channel, "#")
+		}
+	}
+	if config.Slack != nil && config.Slack.Nickname != "" {
+		bot = config.Slack.Nickname
+	}
+	a := &ShellAdapter{
+		r:      r,
+		w:      w,
+		events: make(chan interface{}),
+		done:   make(chan struct{}),
+		me:     &User{ID: "U0", Name: bot},
+		user:   &User{ID: "U1", Name: user},
+	}
+	a.channel = &Channel{
+		ID:       "C1",
+		Name:     channel,
+		Type:     PublicChannel,
+		Members:  []string{a.user.ID, a.me.ID},
+		IsMember: true,
+	}
+	return a
+}
+
+// Name implements the Adapter interface.
+func (a *ShellAdapter) Name() string {
+	return "shell"
+}
+
+// Connect implements the Adapter interface. The input is read until it is
+// exhausted or the context is done.
+func (a *ShellAdapter) Connect(ctx context.Context) error {
+	// The reader can not be interrupted, the goroutine is left behind when
+	// the context is done while it waits for a line.
+	go func() {
+		defer close(a.done)
+		scanner := bufio.NewScanner(a.r)
+		for scanner.Scan() {
+			text := scanner.Text()
+			if strings.TrimSpace(text) == "" {
+				continue
+			}
+			select {
+			case a.events <- a.newMessage(text):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// newMessage returns the Message of a line typed by the user.
+func (a *ShellAdapter) newMessage(text string) *Message {
+	user := *a.user
+	return &Message{
+		Timestamp: a.timestamp(),
+		User:      &user,
+		Channel:   copyChannel(a.channel),
+		RawText:   text,
+		Text:      strings.TrimSpace(text),
+	}
+}
+
+// Done returns a channel that is closed when the input is exhausted.
+func (a *ShellAdapter) Done() <-chan struct{} {
+	return a.done
+}
+
+// Events implements the Adapter interface.
+func (a *ShellAdapter) Events() <-chan interface{} {
+	return a.events
+}
+
+// Send implements the Messenger interface, the message is written right away.
+func (a *ShellAdapter) Send(msg *OutgoingMessage) (*Delivery, error) {
+	a.wmux.Lock()
+	defer a.wmux.Unlock()
+
+	prefix := a.me.Name
+	switch {
+	case msg.Channel == a.user.ID:
+		prefix += " (direct)"
+	case msg.ThreadTimestamp != "":
+		prefix += " (thread)"
+	}
+	_, err := fmt.Fprintf(a.w, "%s> %s\n", prefix, msg.Text)
+	// Attachments are shown by their fallback text, one per line.
+	for _, att := range msg.Attachments {
+		if err != nil {
+			break
+		}
+		_, err = fmt.Fprintf(a.w, "%s> | %s\n", prefix, att.Fallback)
+	}
+
+	d := newDelivery()
+	d.resolve(a.timestamp(), err)
+	return d, err
+}
+
+// timestamp returns a new timestamp for a message, they are sequential.
+func (a *ShellAdapter) timestamp() string {
+	return strconv.FormatInt(atomic.AddInt64(&a.seq, 1), 10) + ".000000"
+}
+
+// Shutdown implements the Messenger interface.
+func (a *ShellAdapter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Close implements the Messenger interface.
+func (a *ShellAdapter) Close() {}
+
+// Me implements the Adapter interface.
+func (a *ShellAdapter) Me() *User {
+	me := *a.me
+	return &me
+}
+
+// User implements the Adapter interface.
+func (a *ShellAdapter) User(id string) *User {
+	for _, u := range []*User{a.me, a.user} {
+		if u.ID == id {
+			c := *u
+			return &c
+		}
+	}
+	return &User{ID: id}
+}
+
+// Channel implements the Adapter interface.
+func (a *ShellAdapter) Channel(id string) (*Channel, bool) {
+	if id == a.channel.ID || strings.TrimPrefix(id, "#") == a.channel.Name {
+		return copyChannel(a.channel), true
+	}
+	return nil, false
+}
+
+// Channels implements the Adapter interface.
+func (a *ShellAdapter) Channels() []*Channel {
+	return []*Channel{copyChannel(a.channel)}
+}
@@ -0,0 +1,65 @@
+package qubot
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"testutil"
+)
+
+// syncBuffer is a bytes.Buffer that can be written and read concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Ensure that the lines read by the shell adapter go through the handlers and
+// that the replies are written to the output.
+func TestShellAdapter(t *testing.T) {
+	config := *testConfig
+	config.Shell = &ShellConfig{User: "alice", Channel: "#dev"}
+	out := &syncBuffer{}
+	a := NewShellAdapter(&config, strings.NewReader("hi\n\nqubot: ping\n"), out)
+
+	q := InitTestQubot()
+	q.config = &config
+	q.a = a
+	h := &msgHandler{msgs: make(chan *Message, 10)}
+	q.Handle(h, &replyHandler{})
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	for _, text := range []string{"hi", "ping"} {
+		select {
+		case msg := <-h.msgs:
+			testutil.Equals(t, text, msg.Text)
+			testutil.Equals(t, "alice", msg.User.Name)
+			testutil.Equals(t, "dev", msg.Channel.Name)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not handled")
+		}
+	}
+	select {
+	case <-a.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("input not exhausted")
+	}
+
+	q.Shutdown()
+	testutil.Equals(t, "qubot> You said: hi\nqubot> You said: qubot: ping\n", out.String())
+}
@@ -2,13 +2,19 @@ package qubot
 
 import (
 	"fmt"
+	"logger"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/nlopes/slack"
+	"golang.org/x/net/context"
 )
 
 // slackClient is the interface of the Slack client.
 type slackClient interface {
 	NewRTM() slackRTMClient
+	NewWeb() slackWebClient
 	AuthTest() (*slack.AuthTestResponse, error)
 }
 
@@ -19,46 +25,565 @@ type slackRTMClient interface {
 	GetInfo() *slack.Info
 	SendMessage(msg *slack.OutgoingMessage)
 	Events() chan slack.RTMEvent
+	OpenIMChannel(user string) (bool, bool, string, error)
 }
 
-type slackClientStruct struct {
-	*slack.Client
+// slackAdapter implements the Adapter interface for Slack using the Real Time
+// Messaging API. The users and the channels of the team are cached and kept in
+// the database.
+type slackAdapter struct {
+	config *Config
+	db     *DB
+	client slackClient
+	rtm    slackRTMClient
+	events chan interface{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// state is the state of the connection.
+	state ConnectionState
+	smux  sync.Mutex
+
+	// m is created once connected, mmux protects it from the senders.
+	m    Messenger
+	mmux sync.RWMutex
+
+	// me is the user of the bot, users the rest of users of the team.
+	me    *User
+	users map[string]*User
+	umux  sync.RWMutex
+
+	// channels is the cache of the channels of the team, see channels.go.
+	channels map[string]*Channel
+	cmux     sync.Mutex
 }
 
-func newSlackClient(key string) slackClient {
-	return &slackClientStruct{slack.New(key)}
+func newSlackAdapter(config *Config, db *DB, client slackClient) *slackAdapter {
+	return &slackAdapter{
+		config:   config,
+		db:       db,
+		client:   client,
+		rtm:      client.NewRTM(),
+		events:   make(chan interface{}),
+		cancel:   func() {},
+		users:    make(map[string]*User),
+		channels: make(map[string]*Channel),
+	}
 }
 
-func (c slackClientStruct) NewRTM() slackRTMClient {
-	return &slackRTMClientStruct{}
+// Name implements the Adapter interface.
+func (s *slackAdapter) Name() string {
+	return "slack"
 }
 
-func (c slackClientStruct) AuthTest() (*slack.AuthTestResponse, error) {
-	resp, err := c.AuthTest()
-	return resp, err
+// Connect implements the Adapter interface.
+func (s *slackAdapter) Connect(ctx context.Context) error {
+	// Don't get too far until we validate our credentials.
+	resp, err := s.client.AuthTest()
+	if err != nil {
+		logger.Error("qubot", "Authentication request test failed")
+		return err
+	}
+	logger.Info("qubot", "Authentication request test succeeded", "url", resp.URL)
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.mmux.Lock()
+	s.cancel = cancel
+	s.m = InitMessenger(ctx, s.rtm, s.client.NewWeb(), s.db, s.config.Messenger)
+	s.mmux.Unlock()
+	// Nothing is posted until the client connects.
+	s.setConnected(false)
+
+	// The client reconnects on its own with a jittered backoff when the
+	// connection drops, ManageConnection only returns when it is disconnected
+	// or when Slack rejects the credentials, both reported as events. It can
+	// not be interrupted while it tries to connect, so it is left behind if it
+	// is still trying when the adapter is closed.
+	go s.rtm.ManageConnection()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.listen(ctx)
+	}()
+	return nil
 }
 
-type slackRTMClientStruct struct {
+// setState changes the state of the connection and lets Qubot know.
+func (s *slackAdapter) setState(ctx context.Context, state ConnectionState, err error) error {
+	s.smux.Lock()
+	// Once the connection fails there is no way back.
+	if s.state == ConnectionFailed || (s.state == state && err == nil) {
+		s.smux.Unlock()
+		return nil
+	}
+	s.state = state
+	s.smux.Unlock()
+	s.setConnected(state == ConnectionConnected)
+	return s.deliver(ctx, &ConnectionEvent{State: state, Err: err})
 }
 
-func (c *slackRTMClientStruct) ManageConnection() {
-	fmt.Println("asdf")
-	c.ManageConnection()
+// listen translates the events received from Slack until the context is done.
+func (s *slackAdapter) listen(ctx context.Context) {
+	for {
+		select {
+		case event := <-s.rtm.Events():
+			if err := s.handleEvent(ctx, &event); err != nil {
+				logger.Warn("qubot", "listen", "error", err)
+			}
+		case <-ctx.Done():
+			logger.Info("qubot", "Disconnecting from Slack RTM")
+			s.rtm.Disconnect()
+			return
+		}
+	}
 }
 
-func (c *slackRTMClientStruct) Disconnect() error {
-	return c.Disconnect()
+// Events implements the Adapter interface.
+func (s *slackAdapter) Events() <-chan interface{} {
+	return s.events
 }
 
-func (c *slackRTMClientStruct) GetInfo() *slack.Info {
-	return c.GetInfo()
+func (s *slackAdapter) messenger() Messenger {
+	s.mmux.RLock()
+	defer s.mmux.RUnlock()
+	return s.m
 }
 
-func (c *slackRTMClientStruct) SendMessage(msg *slack.OutgoingMessage) {
-	c.SendMessage(msg)
+// Send implements the Messenger interface.
+func (s *slackAdapter) Send(msg *OutgoingMessage) (*Delivery, error) {
+	m := s.messenger()
+	if m == nil {
+		return nil, errNotConnected
+	}
+	return m.Send(msg)
+}
+
+// editor returns the messenger as an Editor.
+func (s *slackAdapter) editor() (Editor, error) {
+	m := s.messenger()
+	if m == nil {
+		return nil, errNotConnected
+	}
+	e, ok := m.(Editor)
+	if !ok {
+		return nil, errWebUnavailable
+	}
+	return e, nil
+}
+
+// Update implements the Editor interface.
+func (s *slackAdapter) Update(channel, ts string, msg *OutgoingMessage) error {
+	e, err := s.editor()
+	if err != nil {
+		return err
+	}
+	return e.Update(channel, ts, msg)
+}
+
+// Delete implements the Editor interface.
+func (s *slackAdapter) Delete(channel, ts string) error {
+	e, err := s.editor()
+	if err != nil {
+		return err
+	}
+	return e.Delete(channel, ts)
+}
+
+// React implements the Editor interface.
+func (s *slackAdapter) React(channel, ts, name string) error {
+	e, err := s.editor()
+	if err != nil {
+		return err
+	}
+	return e.React(channel, ts, name)
+}
+
+// Shutdown implements the Messenger interface.
+func (s *slackAdapter) Shutdown(ctx context.Context) error {
+	var err error
+	if m := s.messenger(); m != nil {
+		err = m.Shutdown(ctx)
+	}
+	s.Close()
+	return err
+}
+
+// Close implements the Messenger interface, it disconnects from Slack too.
+func (s *slackAdapter) Close() {
+	s.mmux.RLock()
+	m, cancel := s.m, s.cancel
+	s.mmux.RUnlock()
+	cancel()
+	if m != nil {
+		m.Close()
+	}
+	s.wg.Wait()
+}
+
+// Me implements the Adapter interface.
+func (s *slackAdapter) Me() *User {
+	s.umux.RLock()
+	defer s.umux.RUnlock()
+	if s.me == nil {
+		return nil
+	}
+	me := *s.me
+	return &me
+}
+
+// handleEvents takes each type of event to its corresponding callback.
+// A full list of events can be found in the source code: https://goo.gl/ESCO4K.
+func (s *slackAdapter) handleEvent(ctx context.Context, event *slack.RTMEvent) error {
+	switch e := event.Data.(type) {
+	case *slack.ConnectingEvent:
+		logger.Debug("qubot", "Connection attempt", "count", e.Attempt)
+		return s.setState(ctx, ConnectionConnecting, nil)
+	case *slack.ConnectedEvent:
+		logger.Info("qubot", "Connected to Slack!", "count", e.ConnectionCount)
+		// The team may have changed while we were disconnected.
+		if err := s.onConnectedEvent(e); err != nil {
+			return err
+		}
+		return s.setState(ctx, ConnectionConnected, nil)
+	case *slack.HelloEvent:
+		logger.Info("qubot", "Slack sent greetings!")
+	case *slack.LatencyReport:
+		logger.Debug("qubot", "Latency report", "duration", e.Value)
+	case *slack.MessageEvent:
+		logger.Debug("qubot", "Message received")
+		return s.onMessageEvent(ctx, e)
+	case *slack.AckMessage:
+		s.ack(e.ReplyTo, e.Timestamp, nil)
+	case *slack.AckErrorEvent:
+		// Slack does not tell us which message failed, the messenger will
+		// post it again when the acknowledgement times out.
+		logger.Warn("qubot", "Message rejected by Slack", "error", e)
+	case *slack.OutgoingErrorEvent:
+		s.ack(e.Message.ID, "", e)
+	case *slack.MessageTooLongEvent:
+		s.ack(e.Message.ID, "", e)
+	case *slack.TeamJoinEvent:
+		return s.onUserEvent(&e.User)
+	case *slack.UserChangeEvent:
+		return s.onUserEvent(&e.User)
+	case *slack.ChannelCreatedEvent, *slack.ChannelJoinedEvent, *slack.ChannelLeftEvent,
+		*slack.ChannelRenameEvent, *slack.ChannelArchiveEvent, *slack.ChannelUnarchiveEvent,
+		*slack.ChannelDeletedEvent, *slack.GroupJoinedEvent, *slack.GroupLeftEvent,
+		*slack.GroupRenameEvent, *slack.GroupArchiveEvent, *slack.GroupUnarchiveEvent:
+		return s.onChannelEvent(e)
+	case *slack.ReactionAddedEvent, *slack.ReactionRemovedEvent, *slack.PresenceChangeEvent,
+		*slack.FileSharedEvent, *slack.PinAddedEvent, *slack.PinRemovedEvent:
+		ev, _ := s.newEvent(e)
+		return s.deliver(ctx, ev)
+	case *slack.InvalidAuthEvent:
+		logger.Error("qubot", "Slack rejected the credentials")
+		return s.setState(ctx, ConnectionFailed, ErrInvalidAuth)
+	case *slack.RTMError:
+		logger.Warn("qubot", "Slack reported an error", "error", e)
+	case *slack.ConnectionErrorEvent:
+		// The client keeps trying on its own.
+		logger.Warn("qubot", "Connection attempt failed", "attempt", e.Attempt, "error", e.ErrorObj)
+	case *slack.DisconnectedEvent:
+		if !e.Intentional {
+			return s.setState(ctx, ConnectionDisconnected, nil)
+		}
+	default:
+		logger.Debug("qubot", "Unknown event received", "type", event.Type)
+	}
+	return nil
+}
+
+// setConnected lets the messenger know whether it can post messages.
+func (s *slackAdapter) setConnected(connected bool) {
+	if t, ok := s.messenger().(deliveryTracker); ok {
+		t.setConnected(connected)
+	}
+}
+
+// ack passes the acknowledgement of an outgoing message to the messenger.
+func (s *slackAdapter) ack(id int, ts string, err error) {
+	if t, ok := s.messenger().(deliveryTracker); ok {
+		t.ack(id, ts, err)
+	}
+}
+
+// onConnectedEvent retrieves information about the team and persist it. The
+// cache of users is rebuilt, so the users that left the team while we were
+// disconnected are forgotten.
+func (s *slackAdapter) onConnectedEvent(_ *slack.ConnectedEvent) error {
+	info := s.rtm.GetInfo()
+	if info == nil {
+		return nil
+	}
+	s.umux.Lock()
+	s.users = make(map[string]*User)
+	s.umux.Unlock()
+	for i := range info.Users {
+		user := &info.Users[i]
+		if (info.User != nil && user.ID == info.User.ID) || user.Name == s.config.Slack.Nickname {
+			s.umux.Lock()
+			s.me = newUser(user)
+			s.umux.Unlock()
+			continue
+		}
+		if err := s.syncUser(user); err != nil {
+			logger.Error("qubot", "User could not be saved", "user", user.ID, "error", err)
+		}
+	}
+
+	s.syncChannels(info)
+
+	s.umux.RLock()
+	defer s.umux.RUnlock()
+	logger.Info("qubot", fmt.Sprintf("%d users have been identified (not including me, bots or ignored users)", len(s.users)))
+	return nil
+}
+
+// onUserEvent keeps the directory of users up to date when a user joins the
+// team or when its profile changes, e.g. it is renamed or deactivated.
+func (s *slackAdapter) onUserEvent(user *slack.User) error {
+	if user == nil {
+		return nil
+	}
+	s.umux.Lock()
+	if s.me != nil && s.me.ID == user.ID {
+		s.me = newUser(user)
+		s.umux.Unlock()
+		return nil
+	}
+	s.umux.Unlock()
+	logger.Info("qubot", "User updated", "user", user.ID, "name", user.Name, "deleted", user.Deleted)
+	return s.syncUser(user)
+}
+
+// syncUser updates the cache of users and the database with the details of
+// the user. Bots and ignored users are left out, deleted users are removed
+// from the cache but they are kept in the database.
+func (s *slackAdapter) syncUser(user *slack.User) error {
+	if user.IsBot || s.config.Filters.ignoreUser(user.ID, user.Name) {
+		return nil
+	}
+	u := newUser(user)
+	err := s.db.Update(func(tx *Tx) error {
+		prev, err := tx.User(u.ID)
+		if err != nil {
+			return err
+		}
+		if prev == nil {
+			u.Creation = time.Now()
+			return tx.SaveUser(u)
+		}
+		u.Creation = prev.Creation
+		if *prev == *u {
+			return nil
+		}
+		return tx.SaveUser(u)
+	})
+
+	s.umux.Lock()
+	defer s.umux.Unlock()
+	if u.Deleted {
+		delete(s.users, u.ID)
+	} else {
+		s.users[u.ID] = u
+	}
+	return err
+}
+
+// newUser returns the User that describes a Slack user.
+func newUser(user *slack.User) *User {
+	return &User{
+		ID:       user.ID,
+		Name:     user.Name,
+		RealName: user.RealName,
+		Email:    user.Profile.Email,
+		TimeZone: user.TZ,
+		BotID:    user.Profile.BotID,
+		IsAdmin:  user.IsAdmin,
+		Deleted:  user.Deleted,
+	}
+}
+
+// onMessageEvent delivers the message received, along with the event it
+// stands for, if any, e.g. a user joining the channel.
+func (s *slackAdapter) onMessageEvent(ctx context.Context, e *slack.MessageEvent) error {
+	if err := s.onChannelMessage(e); err != nil {
+		logger.Warn("qubot", "Channel could not be updated", "channel", e.Channel, "error", err)
+	}
+	if ev, ok := s.newEvent(e); ok {
+		if err := s.deliver(ctx, ev); err != nil {
+			return err
+		}
+	}
+
+	msg := newEventMessage(e)
+	msg.User = s.User(msg.User.ID)
+	msg.Channel = s.channel(msg.Channel.ID)
+	return s.deliver(ctx, msg)
+}
+
+// deliver passes the message or the event to Qubot, see Adapter.Events.
+func (s *slackAdapter) deliver(ctx context.Context, event interface{}) error {
+	select {
+	case s.events <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// User implements the Adapter interface. The user is taken from the cache of
+// users or from the database.
+func (s *slackAdapter) User(id string) *User {
+	s.umux.RLock()
+	u, ok := s.users[id]
+	if !ok && s.me != nil && s.me.ID == id {
+		u, ok = s.me, true
+	}
+	s.umux.RUnlock()
+	if ok {
+		c := *u
+		return &c
+	}
+
+	if id != "" {
+		err := s.db.View(func(tx *Tx) error {
+			var err error
+			u, err = tx.User(id)
+			return err
+		})
+		if err != nil {
+			logger.Warn("qubot", "User lookup failed", "user", id, "error", err)
+		}
+	}
+	if u == nil {
+		u = &User{ID: id}
+	}
+	return u
+}
+
+// newEvent converts a Slack event into an Event. The users and channels are
+// resolved with the directory. It returns false when the event is not supported.
+func (s *slackAdapter) newEvent(event interface{}) (Event, bool) {
+	switch e := event.(type) {
+	case *slack.ReactionAddedEvent:
+		return s.newReactionEvent(true, (*slack.ReactionAddedEvent)(e)), true
+	case *slack.ReactionRemovedEvent:
+		return s.newReactionEvent(false, (*slack.ReactionAddedEvent)(e)), true
+	case *slack.PresenceChangeEvent:
+		return &PresenceEvent{User: s.User(e.User), Presence: e.Presence}, true
+	case *slack.FileSharedEvent:
+		return &FileEvent{ID: e.File.ID, Name: e.File.Name, Title: e.File.Title, User: s.User(e.File.User)}, true
+	case *slack.PinAddedEvent:
+		return &PinEvent{Added: true, User: s.User(e.User), Channel: s.channel(e.Channel), Timestamp: itemTimestamp(&e.Item)}, true
+	case *slack.PinRemovedEvent:
+		return &PinEvent{Added: false, User: s.User(e.User), Channel: s.channel(e.Channel), Timestamp: itemTimestamp(&e.Item)}, true
+	case *slack.MessageEvent:
+		switch e.SubType {
+		case "channel_join", "group_join":
+			return &MemberEvent{Joined: true, User: s.User(e.User), Channel: s.channel(e.Channel)}, true
+		case "channel_leave", "group_leave":
+			return &MemberEvent{Joined: false, User: s.User(e.User), Channel: s.channel(e.Channel)}, true
+		}
+	}
+	return nil, false
+}
+
+func (s *slackAdapter) newReactionEvent(added bool, src *slack.ReactionAddedEvent) *ReactionEvent {
+	e := &ReactionEvent{
+		Added:     added,
+		User:      s.User(src.User),
+		Reaction:  src.Reaction,
+		Channel:   s.channel(src.Item.Channel),
+		Timestamp: src.Item.Timestamp,
+	}
+	if src.ItemUser != "" {
+		e.ItemUser = s.User(src.ItemUser)
+	}
+	return e
+}
+
+// itemTimestamp returns the timestamp of the message of the item.
+func itemTimestamp(item *slack.Item) string {
+	if item.Message != nil && item.Message.Timestamp != "" {
+		return item.Message.Timestamp
+	}
+	return item.Timestamp
+}
+
+// newEventMessage returns a new Message built from a message event. When the
+// message was edited, the new version is used.
+func newEventMessage(e *slack.MessageEvent) *Message {
+	return newMessage(&e.Msg, e.SubMessage)
+}
+
+func newMessage(msg, sub *slack.Msg) *Message {
+	m := &Message{
+		Channel: &Channel{ID: msg.Channel, Type: channelType(msg.Channel)},
+		Deleted: msg.SubType == "message_deleted",
+	}
+	src := msg
+	if msg.SubType == "message_changed" && sub != nil {
+		src, m.Edited = sub, true
+	}
+	m.Timestamp = src.Timestamp
+	if m.Deleted && msg.DeletedTimestamp != "" {
+		m.Timestamp = msg.DeletedTimestamp
+	}
+	m.ThreadTimestamp = src.ThreadTimestamp
+	m.User = &User{ID: src.User}
+	m.RawText = src.Text
+	m.Text = strings.TrimSpace(src.Text)
+	m.IsDirect = m.Channel.Type == DirectChannel
+	if msg.BotID != "" || msg.SubType == "bot_message" {
+		m.IsBot, m.BotID, m.BotName = true, msg.BotID, msg.Username
+	}
+	for _, a := range src.Attachments {
+		attachment := Attachment{
+			Title:      a.Title,
+			TitleLink:  a.TitleLink,
+			Pretext:    a.Pretext,
+			Text:       a.Text,
+			Fallback:   a.Fallback,
+			Color:      a.Color,
+			AuthorName: a.AuthorName,
+			AuthorLink: a.AuthorLink,
+			ImageURL:   a.ImageURL,
+			ThumbURL:   a.ThumbURL,
+		}
+		for _, f := range a.Fields {
+			attachment.Fields = append(attachment.Fields, AttachmentField{f.Title, f.Value, f.Short})
+		}
+		m.Attachments = append(m.Attachments, attachment)
+	}
+	return m
+}
+
+// slackClientStruct implements the slackClient interface with the Slack
+// client. The Web API URL is taken from slack.SLACK_API.
+type slackClientStruct struct {
+	*slack.Client
+	key string
+}
+
+func newSlackClient(key string) slackClient {
+	return &slackClientStruct{slack.New(key), key}
+}
+
+func (c *slackClientStruct) NewRTM() slackRTMClient {
+	return &slackRTMClientStruct{c.Client.NewRTM()}
+}
+
+func (c *slackClientStruct) NewWeb() slackWebClient {
+	return newWebClient(c.key)
+}
+
+// slackRTMClientStruct implements the slackRTMClient interface with the RTM
+// client, the events are received from its IncomingEvents channel.
+type slackRTMClientStruct struct {
+	*slack.RTM
 }
 
 func (c *slackRTMClientStruct) Events() chan slack.RTMEvent {
-	ch := make(chan slack.RTMEvent)
-	return ch
+	return c.IncomingEvents
 }
@@ -1,6 +1,22 @@
 package qubot
 
-import "github.com/nlopes/slack"
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"testutil"
+
+	"github.com/nlopes/slack"
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
 
 type fakeSlackClient struct {
 	authTestCalled bool
@@ -11,7 +27,13 @@ func newFakeSlackClient() slackClient {
 }
 
 func (c *fakeSlackClient) NewRTM() slackRTMClient {
-	return &fakeSlackRTMClient{}
+	return newFakeSlackRTMClient()
+}
+
+// NewWeb returns no client, the tests of the Web API use a real one, see
+// newFakeWebAPI.
+func (c *fakeSlackClient) NewWeb() slackWebClient {
+	return nil
 }
 
 func (c *fakeSlackClient) AuthTest() (*slack.AuthTestResponse, error) {
@@ -21,25 +43,363 @@ func (c *fakeSlackClient) AuthTest() (*slack.AuthTestResponse, error) {
 	}, nil
 }
 
+// fakeSlackRTMClient lets the tests push events through the events channel
+// and receive the messages sent through the sent channel. onSend, when set, is
+// called with every message sent, e.g. to acknowledge it. Like the real client,
+// ManageConnection tries again when the connection drops and only returns when
+// the client is disconnected or the credentials are rejected.
 type fakeSlackRTMClient struct {
-	manageConnectionCalled bool
+	connections int32
+	info        *slack.Info
+	events      chan slack.RTMEvent
+	sent        chan *slack.OutgoingMessage
+	onSend      func(msg *slack.OutgoingMessage)
+
+	drops        chan struct{}
+	rejected     chan struct{}
+	disconnected chan struct{}
+	once         sync.Once
+}
+
+func newFakeSlackRTMClient() *fakeSlackRTMClient {
+	return &fakeSlackRTMClient{
+		events:       make(chan slack.RTMEvent, 10),
+		sent:         make(chan *slack.OutgoingMessage, 100),
+		drops:        make(chan struct{}),
+		rejected:     make(chan struct{}),
+		disconnected: make(chan struct{}),
+	}
 }
 
 func (c *fakeSlackRTMClient) ManageConnection() {
-	c.manageConnectionCalled = true
+	for {
+		atomic.AddInt32(&c.connections, 1)
+		select {
+		case <-c.drops:
+			c.events <- slack.RTMEvent{Type: "disconnected", Data: &slack.DisconnectedEvent{}}
+			c.events <- slack.RTMEvent{Type: "connecting", Data: &slack.ConnectingEvent{Attempt: 1}}
+		case <-c.rejected:
+			c.events <- slack.RTMEvent{Type: "invalid_auth", Data: &slack.InvalidAuthEvent{}}
+			return
+		case <-c.disconnected:
+			return
+		}
+	}
+}
+
+// connect tells the adapter that the client is connected, the messages are
+// not posted before.
+func (c *fakeSlackRTMClient) connect() {
+	c.events <- slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{ConnectionCount: 1}}
+}
+
+// drop drops the connection, the client tries again.
+func (c *fakeSlackRTMClient) drop() {
+	c.drops <- struct{}{}
+}
+
+// reject makes Slack reject the credentials, the client gives up.
+func (c *fakeSlackRTMClient) reject() {
+	c.rejected <- struct{}{}
+}
+
+// waitConnections waits until the client has tried to connect n times.
+func (c *fakeSlackRTMClient) waitConnections(n int32, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&c.connections) < n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
 }
 
 func (c *fakeSlackRTMClient) Disconnect() error {
+	c.once.Do(func() { close(c.disconnected) })
 	return nil
 }
 
 func (c *fakeSlackRTMClient) GetInfo() *slack.Info {
-	return nil
+	return c.info
 }
 
-func (c *fakeSlackRTMClient) SendMessage(msg *slack.OutgoingMessage) {}
+func (c *fakeSlackRTMClient) SendMessage(msg *slack.OutgoingMessage) {
+	c.sent <- msg
+	if c.onSend != nil {
+		c.onSend(msg)
+	}
+}
+
+// ackEvents makes the client acknowledge every message sent through its
+// events channel, like Slack does.
+func (c *fakeSlackRTMClient) ackEvents() {
+	c.onSend = func(msg *slack.OutgoingMessage) {
+		c.events <- slack.RTMEvent{Type: "ack", Data: &slack.AckMessage{
+			ReplyTo:     msg.ID,
+			Timestamp:   fmt.Sprintf("1000.%02d", msg.ID),
+			RTMResponse: slack.RTMResponse{Ok: true},
+		}}
+	}
+}
 
 func (c *fakeSlackRTMClient) Events() chan slack.RTMEvent {
-	ch := make(chan slack.RTMEvent, 1)
-	return ch
+	return c.events
+}
+
+func (c *fakeSlackRTMClient) OpenIMChannel(user string) (bool, bool, string, error) {
+	return false, false, "D" + user[1:], nil
+}
+
+// fakeSlackServer is an in-process Slack for end-to-end tests. It serves the
+// methods of the Web API used to connect, auth.test and rtm.start, and a RTM
+// websocket that greets the client, answers its pings and acknowledges its
+// messages. The tests push events to the client with send and receive the
+// messages posted by the bot through the received channel.
+type fakeSlackServer struct {
+	*httptest.Server
+	info      *slack.Info
+	received  chan *slack.OutgoingMessage
+	connected chan struct{}
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+	ts   int
+}
+
+// newFakeSlackServer starts a fake Slack with the team given and points the
+// Slack client to it. The caller must call close.
+func newFakeSlackServer(info *slack.Info) *fakeSlackServer {
+	s := &fakeSlackServer{
+		info:      info,
+		received:  make(chan *slack.OutgoingMessage, 100),
+		connected: make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/auth.test", s.authTest)
+	mux.HandleFunc("/api/rtm.start", s.rtmStart)
+	mux.Handle("/ws", websocket.Handler(s.serveRTM))
+	s.Server = httptest.NewServer(mux)
+	slack.SLACK_API = s.URL + "/api/"
+	return s
+}
+
+func (s *fakeSlackServer) close() {
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+	s.Close()
+	slack.SLACK_API = slackAPI
+}
+
+// slackAPI is the URL of the Slack Web API, it is restored when the fake
+// server is closed.
+var slackAPI = slack.SLACK_API
+
+func (s *fakeSlackServer) authTest(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":      true,
+		"url":     s.URL,
+		"user":    s.info.User.Name,
+		"user_id": s.info.User.ID,
+	})
+}
+
+func (s *fakeSlackServer) rtmStart(w http.ResponseWriter, r *http.Request) {
+	info := *s.info
+	info.URL = "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	json.NewEncoder(w).Encode(struct {
+		Ok bool `json:"ok"`
+		*slack.Info
+	}{true, &info})
+}
+
+// serveRTM greets the client and answers its messages until the connection
+// is closed.
+func (s *fakeSlackServer) serveRTM(conn *websocket.Conn) {
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	s.send(map[string]string{"type": "hello"})
+	close(s.connected)
+
+	for {
+		var msg slack.OutgoingMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case "ping":
+			s.send(map[string]interface{}{"type": "pong", "reply_to": msg.ID})
+		case "message":
+			s.mu.Lock()
+			s.ts++
+			ts := fmt.Sprintf("2000.%02d", s.ts)
+			s.mu.Unlock()
+			s.send(map[string]interface{}{"ok": true, "reply_to": msg.ID, "ts": ts, "text": msg.Text})
+			s.received <- &msg
+		}
+	}
+}
+
+// send writes the event to the RTM websocket.
+func (s *fakeSlackServer) send(event interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return websocket.JSON.Send(s.conn, event)
+}
+
+// Ensure that the Slack adapter works end to end with the Slack client: the
+// team is loaded once connected, the messages reach the handlers and the
+// replies are acknowledged by Slack.
+func TestSlackAdapter_endToEnd(t *testing.T) {
+	srv := newFakeSlackServer(testInfo())
+	defer srv.close()
+
+	q := InitTestQubot()
+	q.a = newSlackAdapter(testConfig, q.db, newSlackClient("xoxb-12345"))
+	h := &msgHandler{msgs: make(chan *Message, 10)}
+	eh := &eventTestHandler{events: make(chan Event, 10)}
+	q.Handle(h, &replyHandler{}, eh)
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	select {
+	case <-srv.connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client not connected")
+	}
+	testutil.Ok(t, srv.send(map[string]string{
+		"type":    "message",
+		"channel": "C100",
+		"user":    "U100",
+		"text":    "<@U001> ping",
+		"ts":      "1000.01",
+	}))
+
+	select {
+	case msg := <-h.msgs:
+		testutil.Equals(t, "ping", msg.Text)
+		testutil.Equals(t, "alice", msg.User.Name)
+		testutil.Equals(t, "general", msg.Channel.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not handled")
+	}
+	select {
+	case msg := <-srv.received:
+		testutil.Equals(t, "C100", msg.Channel)
+		testutil.Equals(t, "You said: <@U001> ping", msg.Text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply not received")
+	}
+
+	testutil.Ok(t, srv.send(map[string]interface{}{
+		"type":     "reaction_added",
+		"user":     "U200",
+		"reaction": "thumbsup",
+		"item":     map[string]string{"type": "message", "channel": "C100", "ts": "1000.01"},
+	}))
+	select {
+	case e := <-eh.events:
+		r := e.(*ReactionEvent)
+		testutil.Equals(t, "bob", r.User.Name)
+		testutil.Equals(t, "thumbsup", r.Reaction)
+		testutil.Equals(t, "1000.01", r.Timestamp)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not handled")
+	}
+
+	q.Shutdown()
+	<-q.Done()
+}
+
+// connTestHandler implements the Handler and EventHandler interfaces, it
+// subscribes to the changes of the state of the connection.
+type connTestHandler struct {
+	events chan *ConnectionEvent
+}
+
+func (h *connTestHandler) Start(ctx context.Context) error { return nil }
+
+func (h *connTestHandler) Handle(ctx context.Context, r Response, msg *Message) {}
+
+func (h *connTestHandler) Events() []EventKind {
+	return []EventKind{ConnectionChanged}
+}
+
+func (h *connTestHandler) HandleEvent(ctx context.Context, r Response, e Event) {
+	h.events <- e.(*ConnectionEvent)
+}
+
+func (h *connTestHandler) wait(t *testing.T, state ConnectionState) *ConnectionEvent {
+	select {
+	case e := <-h.events:
+		testutil.Equals(t, state, e.State)
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection state %s not received", state)
+	}
+	return nil
+}
+
+// Ensure that the handlers are told when the connection drops and the client
+// connects again, and that the team is synchronized after each connection.
+func TestSlackAdapter_reconnect(t *testing.T) {
+	q := InitTestQubot()
+	s := testSlack(q)
+	rtm := testRTM(q)
+	rtm.info = testInfo()
+	h := &connTestHandler{events: make(chan *ConnectionEvent, 10)}
+	q.Handle(h)
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	rtm.events <- slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{ConnectionCount: 1}}
+	h.wait(t, ConnectionConnected)
+
+	rtm.drop()
+	h.wait(t, ConnectionDisconnected)
+	h.wait(t, ConnectionConnecting)
+	testutil.Assert(t, rtm.waitConnections(2, 5*time.Second), "the client should try again")
+
+	// Bob leaves the team and #random is deleted while we are away.
+	info := testInfo()
+	info.Users = info.Users[:len(info.Users)-1]
+	info.Channels = info.Channels[:1]
+	rtm.info = info
+	rtm.events <- slack.RTMEvent{Type: "connected", Data: &slack.ConnectedEvent{ConnectionCount: 1}}
+	h.wait(t, ConnectionConnected)
+
+	s.umux.RLock()
+	_, ok := s.users["U200"]
+	s.umux.RUnlock()
+	testutil.Assert(t, !ok, "bob should not be cached")
+	_, ok = q.Channel("#random")
+	testutil.Assert(t, !ok, "#random should be gone")
+	_, ok = q.Channel("#general")
+	testutil.Assert(t, ok, "#general should be kept")
+}
+
+// Ensure that Qubot shuts down when Slack rejects its credentials.
+func TestSlackAdapter_invalidAuth(t *testing.T) {
+	q := InitTestQubot()
+	h := &connTestHandler{events: make(chan *ConnectionEvent, 10)}
+	q.Handle(h)
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	rtm := testRTM(q)
+	testutil.Assert(t, rtm.waitConnections(1, time.Second), "the client should be started")
+	rtm.reject()
+	e := h.wait(t, ConnectionFailed)
+	testutil.Equals(t, ErrInvalidAuth, e.Err)
+
+	select {
+	case <-q.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("qubot did not shut down")
+	}
+	testutil.Equals(t, ErrInvalidAuth, q.Err())
 }
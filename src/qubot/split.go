@@ -0,0 +1,188 @@
+package qubot
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// fence opens and closes the code blocks of a message.
+const fence = "```"
+
+// maxLangLength is the length of the longest language tag, after the fence
+// that opens a code block, kept when the block is opened again.
+const maxLangLength = 20
+
+// splitText splits the text in parts of at most max bytes, the length Slack
+// checks. The text is split between lines and the code blocks are kept whole
+// when they fit in a part. A code block that does not fit is closed at the end
+// of each part and opened again at the beginning of the next one so the fences
+// stay balanced. Lines longer than max are split between words when possible.
+// max has to leave room for a line of text along with the fences.
+func splitText(text string, max int) []string {
+	if len(text) <= max {
+		return []string{text}
+	}
+	s := &splitter{max: max}
+	for _, b := range textBlocks(strings.Split(text, "\n")) {
+		s.addBlock(b)
+	}
+	s.flush()
+	return s.parts
+}
+
+// textBlock is a line of text or a whole code block, fences included.
+type textBlock struct {
+	lines []string
+	code  bool
+}
+
+// textBlocks groups the lines of a code block together. A code block that is
+// not closed runs until the end of the text.
+func textBlocks(lines []string) []textBlock {
+	var res []textBlock
+	for i := 0; i < len(lines); i++ {
+		if !togglesFence(lines[i]) {
+			res = append(res, textBlock{lines: lines[i : i+1]})
+			continue
+		}
+		j := i + 1
+		for j < len(lines) && !togglesFence(lines[j]) {
+			j++
+		}
+		if j == len(lines) {
+			j--
+		}
+		res = append(res, textBlock{lines: lines[i : j+1], code: true})
+		i = j
+	}
+	return res
+}
+
+// togglesFence reports whether a code block is opened or closed in the line,
+// blocks that start and end in the same line do not count.
+func togglesFence(line string) bool {
+	return strings.Count(line, fence)%2 == 1
+}
+
+// splitter packs the blocks of a text in parts.
+type splitter struct {
+	max   int
+	parts []string
+	cur   []string
+	n     int
+}
+
+// add appends the line to the current part, a new part is started when the
+// line does not fit.
+func (s *splitter) add(line string) {
+	if len(s.cur) > 0 && s.n+1+len(line) > s.max {
+		s.flush()
+	}
+	if len(s.cur) > 0 {
+		s.n++
+	}
+	s.cur = append(s.cur, line)
+	s.n += len(line)
+}
+
+// flush closes the current part.
+func (s *splitter) flush() {
+	if len(s.cur) > 0 {
+		s.parts = append(s.parts, strings.Join(s.cur, "\n"))
+	}
+	s.cur, s.n = nil, 0
+}
+
+func (s *splitter) addBlock(b textBlock) {
+	text := strings.Join(b.lines, "\n")
+	switch {
+	case len(text) <= s.max:
+		s.add(text)
+	case !b.code:
+		for _, chunk := range splitLine(text, s.max) {
+			s.add(chunk)
+		}
+	default:
+		s.addCode(b.lines)
+	}
+}
+
+// addCode splits a code block that does not fit in a part. The block is
+// opened again with its language, if any, in the parts that follow the first.
+// The lines are split as plain text when max leaves no room for the fences.
+func (s *splitter) addCode(lines []string) {
+	reopen := fence
+	if l := strings.TrimSpace(lines[0]); strings.HasPrefix(l, fence) && isLang(l[len(fence):]) {
+		reopen = l
+	}
+	// Room left in a part for a line of code, between the fences.
+	room := s.max - len(reopen) - len(fence) - 2
+
+	s.flush()
+	if room < 1 {
+		for _, line := range lines {
+			for _, chunk := range splitLine(line, s.max) {
+				s.add(chunk)
+			}
+		}
+		return
+	}
+	for i, line := range lines {
+		for _, chunk := range splitLine(line, room) {
+			// The part has to be closed after the chunk unless it is
+			// the end of the block.
+			n := s.n + 1 + len(chunk)
+			if i < len(lines)-1 {
+				n += 1 + len(fence)
+			}
+			if len(s.cur) > 0 && n > s.max {
+				s.add(fence)
+				s.flush()
+				s.add(reopen)
+			}
+			s.add(chunk)
+		}
+	}
+}
+
+// isLang reports whether the text after the fence that opens a code block is
+// a short language tag, e.g. "go".
+func isLang(tag string) bool {
+	if len(tag) > maxLangLength {
+		return false
+	}
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("+-#._", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitLine splits the line in chunks of at most max bytes. The line is split
+// at the last space that fits, which is dropped, or else at the last rune that
+// fits. A rune longer than max makes a chunk of its own.
+func splitLine(line string, max int) []string {
+	if max < 1 {
+		return []string{line}
+	}
+	var res []string
+	for len(line) > max {
+		i := max
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		if i == 0 {
+			_, i = utf8.DecodeRuneInString(line)
+		}
+		if j := strings.LastIndexAny(line[:i], " \t"); j > 0 {
+			res = append(res, line[:j])
+			line = line[j+1:]
+			continue
+		}
+		res = append(res, line[:i])
+		line = line[i:]
+	}
+	return append(res, line)
+}
@@ -0,0 +1,88 @@
+package qubot
+
+import (
+	"strings"
+	"testing"
+
+	"testutil"
+)
+
+// Ensure that texts are split between lines and that the code blocks keep
+// their fences balanced.
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		text  string
+		max   int
+		parts []string
+	}{
+		{"short", 20, []string{"short"}},
+		{"aaaa\nbbbb\ncccc", 10, []string{"aaaa\nbbbb", "cccc"}},
+		{"aaaa\n\nbbbb\ncccc", 10, []string{"aaaa\n\nbbbb", "cccc"}},
+		{"aaaa bbbb cccc", 10, []string{"aaaa bbbb", "cccc"}},
+		{"aaaaaaaaaaaa", 10, []string{"aaaaaaaaaa", "aa"}},
+		{"ñññññ", 5, []string{"ññ", "ññ", "ñ"}},
+		// The code block is moved to the next part when it fits there.
+		{"aa\n```\nbb\n```", 12, []string{"aa", "```\nbb\n```"}},
+		// Otherwise it is closed and opened again.
+		{"```go\nx := 1\ny := 2\n```\nend", 22, []string{"```go\nx := 1\n```", "```go\ny := 2\n```\nend"}},
+		{"```\naaaa\nbbbb\ncccc\n```", 16, []string{"```\naaaa\n```", "```\nbbbb\n```", "```\ncccc\n```"}},
+		// Blocks that start and end in the same line are plain text.
+		{"```aa``` bb\ncc", 10, []string{"```aa```", "bb\ncc"}},
+	}
+	for _, tt := range tests {
+		parts := splitText(tt.text, tt.max)
+		testutil.Equals(t, tt.parts, parts)
+		for _, p := range parts {
+			testutil.Assert(t, len(p) <= tt.max, "part %q is longer than %d", p, tt.max)
+		}
+	}
+}
+
+// Ensure that a code block opened by a long line is split without opening
+// the block again with that line.
+func TestSplitText_longFence(t *testing.T) {
+	text := fence + strings.Repeat("x", 4000) + "\ncode\n" + fence
+	parts := splitText(text, 4000)
+	strip := strings.NewReplacer(fence, "", "\n", "")
+	testutil.Equals(t, strip.Replace(text), strip.Replace(strings.Join(parts, "")))
+	for _, p := range parts {
+		testutil.Assert(t, len(p) <= 4000, "part of %d bytes", len(p))
+		testutil.Equals(t, 0, strings.Count(p, fence)%2)
+	}
+
+	// There is no room for the fences, the lines are split as text.
+	testutil.Equals(t, []string{"```go", "abc\ndef", "```"}, splitText("```go\nabc\ndef\n```", 8))
+}
+
+// Ensure that a long text with code blocks is split in parts with balanced
+// fences and that nothing is lost.
+func TestSplitText_balanced(t *testing.T) {
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = append(lines, "issue #1234: the quick brown fox jumps over the lazy dog")
+		if i%10 == 0 {
+			lines = append(lines, "```", "func main() {", "\tfmt.Println(\"hello\")", "}", "```")
+		}
+	}
+	text := strings.Join(lines, "\n")
+	parts := splitText(text, 200)
+	testutil.Assert(t, len(parts) > 1, "expected several parts")
+
+	var got []string
+	for _, p := range parts {
+		testutil.Assert(t, len(p) <= 200, "part %q is too long", p)
+		testutil.Equals(t, 0, strings.Count(p, fence)%2)
+		for _, line := range strings.Split(p, "\n") {
+			if line != fence {
+				got = append(got, line)
+			}
+		}
+	}
+	var want []string
+	for _, line := range lines {
+		if line != fence {
+			want = append(want, line)
+		}
+	}
+	testutil.Equals(t, want, got)
+}
@@ -0,0 +1,358 @@
+package qubot
+
+import (
+	"fmt"
+	"logger"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Supervisor settings: the time waited before restarting a handler doubles
+// after each failure, and handlers that fail too many times in a row are given
+// up. A handler that ran for longer than supBackoffMax before failing starts
+// counting again.
+const (
+	supBackoffMin  = time.Second
+	supBackoffMax  = 5 * time.Minute
+	supMaxRestarts = 10
+)
+
+// HandlerState is the state of a handler supervised by Qubot.
+type HandlerState int
+
+// These are the states of a handler.
+const (
+	// HandlerIdle is the state of the handlers before Qubot starts.
+	HandlerIdle HandlerState = iota
+	// HandlerRunning handlers are in their Start method.
+	HandlerRunning
+	// HandlerBackingOff handlers failed and are waiting to be restarted.
+	HandlerBackingOff
+	// HandlerFailed handlers failed too many times in a row and are not
+	// restarted.
+	HandlerFailed
+	// HandlerStopped handlers returned from Start without an error or
+	// were cancelled.
+	HandlerStopped
+	// HandlerDisabled handlers have been switched off, see
+	// Qubot.DisableHandler.
+	HandlerDisabled
+)
+
+func (s HandlerState) String() string {
+	switch s {
+	case HandlerIdle:
+		return "idle"
+	case HandlerRunning:
+		return "running"
+	case HandlerBackingOff:
+		return "backing off"
+	case HandlerFailed:
+		return "failed"
+	case HandlerStopped:
+		return "stopped"
+	case HandlerDisabled:
+		return "disabled"
+	}
+	return "unknown"
+}
+
+// HandlerStatus describes a handler registered with Qubot.
+type HandlerStatus struct {
+	Name     string
+	State    HandlerState
+	Restarts int
+	Err      error
+}
+
+// supervisedHandler wraps a Handler, restarting it with an exponential
+// backoff when its Start method fails and recovering from the panics of its
+// methods.
+type supervisedHandler struct {
+	h    Handler
+	name string
+	// mws are the middlewares of the handler, chain is the handler wrapped
+	// with the global middlewares and mws.
+	mws   []Middleware
+	chain Handler
+	// events are the kinds of event that the handler subscribed to, see
+	// EventHandler.
+	events map[EventKind]bool
+
+	backoffMin  time.Duration
+	backoffMax  time.Duration
+	maxRestarts int
+
+	mux      sync.Mutex
+	state    HandlerState
+	restarts int
+	err      error
+	disabled bool
+	cancel   context.CancelFunc
+	// gen counts the launches of the handler, so a run that was stopped
+	// does not overwrite the state of the run that replaced it. done is
+	// closed when the last run returns.
+	gen  int
+	done chan struct{}
+}
+
+func newSupervisedHandler(h Handler, mws ...Middleware) *supervisedHandler {
+	sh := &supervisedHandler{
+		h:           h,
+		name:        handlerName(h),
+		mws:         mws,
+		chain:       Chain(h, mws...),
+		events:      make(map[EventKind]bool),
+		backoffMin:  supBackoffMin,
+		backoffMax:  supBackoffMax,
+		maxRestarts: supMaxRestarts,
+	}
+	if eh, ok := h.(EventHandler); ok {
+		for _, kind := range eh.Events() {
+			sh.events[kind] = true
+		}
+	}
+	return sh
+}
+
+// handlerName returns the name used to identify the handler in the logs.
+func handlerName(h Handler) string {
+	for {
+		w, ok := h.(*wrappedHandler)
+		if !ok {
+			break
+		}
+		h = w.Handler
+	}
+	if lh, ok := h.(*legacyHandler); ok {
+		return reflect.TypeOf(lh.LegacyHandler).String()
+	}
+	return reflect.TypeOf(h).String()
+}
+
+// run starts the handler and restarts it when it fails until the context is
+// done or the handler fails too many times. gen is the launch the run belongs
+// to.
+func (sh *supervisedHandler) run(ctx context.Context, gen int) {
+	setState := func(state HandlerState, err error) {
+		sh.mux.Lock()
+		defer sh.mux.Unlock()
+		if sh.gen == gen {
+			sh.state, sh.err = state, err
+		}
+	}
+
+	backoff := sh.backoffMin
+	// failures counts the recent failures, restarts all of them.
+	failures := 0
+	for {
+		setState(HandlerRunning, nil)
+		started := time.Now()
+		err := sh.start(ctx)
+		if ctx.Err() != nil || err == nil {
+			setState(HandlerStopped, err)
+			return
+		}
+
+		// A handler that has been running for a while deserves a quick
+		// restart and a clean slate.
+		if time.Since(started) > sh.backoffMax {
+			backoff, failures = sh.backoffMin, 0
+		}
+		failures++
+
+		sh.mux.Lock()
+		sh.restarts++
+		restarts := sh.restarts
+		sh.mux.Unlock()
+		if failures > sh.maxRestarts {
+			logger.Error("qubot", fmt.Sprintf("Handler %s failed too many times", sh.name), "error", err)
+			setState(HandlerFailed, err)
+			return
+		}
+
+		logger.Warn("qubot", fmt.Sprintf("Handler %s terminated", sh.name), "error", err, "restart", restarts, "backoff", backoff)
+		setState(HandlerBackingOff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			setState(HandlerStopped, err)
+			return
+		}
+		if backoff *= 2; backoff > sh.backoffMax {
+			backoff = sh.backoffMax
+		}
+	}
+}
+
+// start calls the Start method of the handler, a panic is turned into an
+// error.
+func (sh *supervisedHandler) start(ctx context.Context) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return sh.h.Start(ctx)
+}
+
+// handle passes the message to the handler if it matches. A panic only
+// affects the handler that caused it.
+func (sh *supervisedHandler) handle(ctx context.Context, r Response, msg *Message) {
+	defer func() {
+		if p := recover(); p != nil {
+			logger.Error("qubot", fmt.Sprintf("Handler %s panicked", sh.name), "panic", p)
+		}
+	}()
+	if s := sh.State(); s == HandlerFailed || s == HandlerDisabled {
+		return
+	}
+	if a, ok := sh.h.(AddressedHandler); ok && a.AddressedOnly() && !msg.Addressed() {
+		return
+	}
+	if m, ok := sh.h.(HandlerMatcher); ok && !m.Match(r, msg) {
+		return
+	}
+	sh.mux.Lock()
+	chain := sh.chain
+	sh.mux.Unlock()
+	chain.Handle(ctx, r, msg)
+}
+
+// subscribed returns true if the handler wants to receive the events of the
+// kind given.
+func (sh *supervisedHandler) subscribed(kind EventKind) bool {
+	return sh.events[kind]
+}
+
+// handleEvent passes the event to the handler. A panic only affects the
+// handler that caused it.
+func (sh *supervisedHandler) handleEvent(ctx context.Context, r Response, event Event) {
+	defer func() {
+		if p := recover(); p != nil {
+			logger.Error("qubot", fmt.Sprintf("Handler %s panicked", sh.name), "panic", p)
+		}
+	}()
+	if s := sh.State(); s == HandlerFailed || s == HandlerDisabled {
+		return
+	}
+	if eh, ok := sh.h.(EventHandler); ok {
+		eh.HandleEvent(ctx, r, event)
+	}
+}
+
+// use wraps the handler with the global middlewares, which go before the
+// middlewares of the handler.
+func (sh *supervisedHandler) use(global []Middleware) {
+	mws := make([]Middleware, 0, len(global)+len(sh.mws))
+	mws = append(append(mws, global...), sh.mws...)
+	chain := Chain(sh.h, mws...)
+
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	sh.chain = chain
+}
+
+func (sh *supervisedHandler) setState(state HandlerState, err error) {
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	sh.state, sh.err = state, err
+}
+
+// State returns the current state of the handler.
+func (sh *supervisedHandler) State() HandlerState {
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	if sh.disabled {
+		return HandlerDisabled
+	}
+	return sh.state
+}
+
+// launch runs the handler in the background with its own context, derived
+// from parent, until it is stopped or the context is done. The wait group is
+// done when the handler returns. A run that was stopped may still be in the
+// Start method of the handler, the new run waits for it to return so Start is
+// never called twice at once.
+func (sh *supervisedHandler) launch(parent context.Context, wg *sync.WaitGroup) {
+	ctx, cancel := context.WithCancel(parent)
+	done := make(chan struct{})
+	sh.mux.Lock()
+	sh.cancel = cancel
+	sh.gen++
+	gen := sh.gen
+	prev := sh.done
+	sh.done = done
+	sh.mux.Unlock()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		defer cancel()
+		if prev != nil {
+			select {
+			case <-prev:
+			case <-ctx.Done():
+				return
+			}
+		}
+		sh.run(ctx, gen)
+	}()
+}
+
+// stop cancels the context of the handler. It does not wait for its Start
+// method to return, see launch.
+func (sh *supervisedHandler) stop() {
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	if sh.cancel != nil {
+		sh.cancel()
+		sh.cancel = nil
+	}
+}
+
+// setDisabled switches the handler off or back on. A handler that is
+// switched on gets a clean slate, so a failed handler can be given another
+// chance.
+func (sh *supervisedHandler) setDisabled(disabled bool) {
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	sh.disabled = disabled
+	if !disabled {
+		sh.state, sh.restarts, sh.err = HandlerIdle, 0, nil
+	}
+}
+
+// isDisabled returns true if the handler has been switched off.
+func (sh *supervisedHandler) isDisabled() bool {
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	return sh.disabled
+}
+
+// status returns a snapshot of the state of the handler.
+func (sh *supervisedHandler) status() HandlerStatus {
+	sh.mux.Lock()
+	defer sh.mux.Unlock()
+
+	state := sh.state
+	if sh.disabled {
+		state = HandlerDisabled
+	}
+	return HandlerStatus{
+		Name:     sh.name,
+		State:    state,
+		Restarts: sh.restarts,
+		Err:      sh.err,
+	}
+}
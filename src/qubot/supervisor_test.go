@@ -0,0 +1,276 @@
+package qubot
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"testutil"
+
+	"golang.org/x/net/context"
+)
+
+// flakyHandler implements the Handler interface. Its Start method fails the
+// given number of times, or panics when panics is set, after running for
+// runFor, and then blocks until the context is done.
+type flakyHandler struct {
+	failures int
+	panics   bool
+	runFor   time.Duration
+	starts   chan struct{}
+}
+
+func newFlakyHandler(failures int) *flakyHandler {
+	return &flakyHandler{failures: failures, starts: make(chan struct{}, 100)}
+}
+
+func (h *flakyHandler) Start(ctx context.Context) error {
+	h.starts <- struct{}{}
+	if h.failures > 0 {
+		time.Sleep(h.runFor)
+		h.failures--
+		if h.panics {
+			panic("boom")
+		}
+		return errors.New("failed")
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (h *flakyHandler) Handle(ctx context.Context, r Response, msg *Message) {}
+
+// newTestSupervisedHandler returns a supervised handler with short backoffs.
+func newTestSupervisedHandler(h Handler) *supervisedHandler {
+	sh := newSupervisedHandler(h)
+	sh.backoffMin = time.Millisecond
+	sh.backoffMax = 4 * time.Millisecond
+	sh.maxRestarts = 3
+	return sh
+}
+
+// waitState waits until the handler reaches the state.
+func waitState(t *testing.T, sh *supervisedHandler, state HandlerState) HandlerStatus {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		if s := sh.status(); s.State == state {
+			return s
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("handler did not reach state %s, last state was %s", state, sh.State())
+	return HandlerStatus{}
+}
+
+// Ensure that failed handlers are restarted until they run.
+func TestSupervisedHandler_restart(t *testing.T) {
+	h := newFlakyHandler(2)
+	sh := newTestSupervisedHandler(h)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sh.run(ctx, 0)
+		close(done)
+	}()
+
+	// The handler is running once it has been started three times.
+	for i := 0; i < 3; i++ {
+		select {
+		case <-h.starts:
+		case <-time.After(time.Second * 5):
+			t.Fatal("handler not restarted")
+		}
+	}
+	s := waitState(t, sh, HandlerRunning)
+	testutil.Equals(t, 2, s.Restarts)
+
+	cancel()
+	<-done
+	testutil.Equals(t, HandlerStopped, sh.State())
+}
+
+// Ensure that handlers that fail too many times are given up, panics
+// included, and that they do not get messages anymore.
+func TestSupervisedHandler_failed(t *testing.T) {
+	h := newFlakyHandler(10)
+	h.panics = true
+	sh := newTestSupervisedHandler(h)
+	sh.run(context.Background(), 0)
+
+	s := sh.status()
+	testutil.Equals(t, HandlerFailed, s.State)
+	testutil.Equals(t, 4, s.Restarts)
+	testutil.Equals(t, "panic: boom", s.Err.Error())
+	testutil.Equals(t, 4, len(h.starts))
+
+	rh := &replyHandler{}
+	sh = newTestSupervisedHandler(rh)
+	sh.setState(HandlerFailed, nil)
+	m := &fakeMessenger{}
+	msg := newTestMessage("hi")
+	sh.handle(context.Background(), NewResponse(m, msg), msg)
+	testutil.Equals(t, 0, len(m.texts()))
+}
+
+// Ensure that the handlers that fail once in a while, after running for a
+// while, are not given up.
+func TestSupervisedHandler_occasionalFailures(t *testing.T) {
+	h := newFlakyHandler(6)
+	sh := newTestSupervisedHandler(h)
+	h.runFor = sh.backoffMax * 2
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sh.run(ctx, 0)
+		close(done)
+	}()
+
+	for i := 0; i < 7; i++ {
+		select {
+		case <-h.starts:
+		case <-time.After(time.Second * 5):
+			t.Fatal("handler not restarted")
+		}
+	}
+	s := waitState(t, sh, HandlerRunning)
+	testutil.Equals(t, 6, s.Restarts)
+
+	cancel()
+	<-done
+	testutil.Equals(t, HandlerStopped, sh.State())
+}
+
+// panicHandler implements the Handler interface, it panics when it handles a
+// message.
+type panicHandler struct{}
+
+func (h *panicHandler) Start(ctx context.Context) error { return nil }
+
+func (h *panicHandler) Handle(ctx context.Context, r Response, msg *Message) {
+	panic("boom")
+}
+
+// Ensure that a handler that panics does not prevent the rest of handlers
+// from getting the message.
+func TestQubot_handlerPanic(t *testing.T) {
+	q := InitTestQubot()
+	h := &ctxHandler{ctxs: make(chan context.Context, 1)}
+	q.Handle(&panicHandler{}, h)
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	testRTM(q).events <- *newTestMessageEvent("C100", "hi")
+	select {
+	case <-h.ctxs:
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not handled")
+	}
+
+	statuses := q.Handlers()
+	testutil.Equals(t, 2, len(statuses))
+	testutil.Equals(t, "*qubot.panicHandler", statuses[0].Name)
+}
+
+// Ensure that handlers can be added, disabled, enabled and removed while
+// Qubot is running.
+func TestQubot_runtimeHandlers(t *testing.T) {
+	q := InitTestQubot()
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	started := func(h *flakyHandler) {
+		select {
+		case <-h.starts:
+		case <-time.After(time.Second * 5):
+			t.Fatal("handler not started")
+		}
+	}
+
+	h := newFlakyHandler(0)
+	q.Handle(h, newFlakyHandler(0))
+	started(h)
+	testutil.Equals(t, "*qubot.flakyHandler", q.Handlers()[0].Name)
+	testutil.Equals(t, "*qubot.flakyHandler#2", q.Handlers()[1].Name)
+
+	testutil.Ok(t, q.DisableHandler("*qubot.flakyHandler"))
+	testutil.Equals(t, HandlerDisabled, q.Handlers()[0].State)
+	testutil.Ok(t, q.EnableHandler("*qubot.flakyHandler"))
+	started(h)
+
+	testutil.Ok(t, q.RemoveHandler("*qubot.flakyHandler#2"))
+	testutil.Equals(t, 1, len(q.Handlers()))
+	testutil.Equals(t, ErrHandlerNotFound, q.RemoveHandler("*qubot.flakyHandler#2"))
+	testutil.Equals(t, ErrHandlerNotFound, q.EnableHandler("foo"))
+}
+
+// slowStopHandler implements the Handler interface. Its Start method takes a
+// while to return once the context is done, it records how many calls to
+// Start overlap.
+type slowStopHandler struct {
+	mux     sync.Mutex
+	active  int
+	overlap int
+	starts  chan struct{}
+}
+
+func (h *slowStopHandler) Start(ctx context.Context) error {
+	h.mux.Lock()
+	if h.active++; h.active > 1 {
+		h.overlap++
+	}
+	h.mux.Unlock()
+	h.starts <- struct{}{}
+
+	<-ctx.Done()
+	time.Sleep(50 * time.Millisecond)
+	h.mux.Lock()
+	h.active--
+	h.mux.Unlock()
+	return nil
+}
+
+func (h *slowStopHandler) Handle(ctx context.Context, r Response, msg *Message) {}
+
+// Ensure that a handler that is enabled right after being disabled is not
+// started before its previous Start returns.
+func TestQubot_reenableHandler(t *testing.T) {
+	q := InitTestQubot()
+	h := &slowStopHandler{starts: make(chan struct{}, 10)}
+	q.Handle(h)
+	testutil.Ok(t, q.Start())
+
+	<-h.starts
+	testutil.Ok(t, q.DisableHandler("*qubot.slowStopHandler"))
+	testutil.Ok(t, q.EnableHandler("*qubot.slowStopHandler"))
+	select {
+	case <-h.starts:
+	case <-time.After(time.Second * 5):
+		t.Fatal("handler not started again")
+	}
+	q.Close()
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	testutil.Equals(t, 0, h.overlap)
+}
+
+// Ensure that disabled handlers do not get messages.
+func TestQubot_disabledHandler(t *testing.T) {
+	q := InitTestQubot()
+	off := &ctxHandler{ctxs: make(chan context.Context, 1)}
+	on := &ctxHandler{ctxs: make(chan context.Context, 1)}
+	q.Handle(off)
+	testutil.Ok(t, q.DisableHandler("*qubot.ctxHandler"))
+	q.Handle(on)
+	testutil.Ok(t, q.Start())
+	defer q.Close()
+
+	testRTM(q).events <- *newTestMessageEvent("C100", "hi")
+	select {
+	case <-on.ctxs:
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not handled")
+	}
+	testutil.Equals(t, 0, len(off.ctxs))
+}
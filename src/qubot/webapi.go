@@ -0,0 +1,229 @@
+package qubot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// webTimeout is how long we wait for a call to the Web API.
+const webTimeout = 30 * time.Second
+
+// errWebUnavailable is returned when a message can not be changed because the
+// messenger has no Web API client.
+var errWebUnavailable = errors.New("messenger: web api not available")
+
+// slackWebClient is the interface of the methods of the Slack Web API used to
+// do what the RTM API can not: rich messages, changes to the messages already
+// posted and reactions.
+type slackWebClient interface {
+	PostMessage(msg *OutgoingMessage) (string, error)
+	UpdateMessage(channel, ts string, msg *OutgoingMessage) error
+	DeleteMessage(channel, ts string) error
+	AddReaction(channel, ts, name string) error
+}
+
+// webPermanentErrors are the error codes of the Web API that Slack will
+// answer again if the same call is made again, the rest are worth a retry.
+var webPermanentErrors = map[string]bool{
+	"channel_not_found":    true,
+	"not_in_channel":       true,
+	"is_archived":          true,
+	"msg_too_long":         true,
+	"no_text":              true,
+	"too_many_attachments": true,
+	"restricted_action":    true,
+	"cant_update_message":  true,
+	"cant_delete_message":  true,
+	"message_not_found":    true,
+	"edit_window_closed":   true,
+	"invalid_name":         true,
+	"invalid_auth":         true,
+	"not_authed":           true,
+	"account_inactive":     true,
+	"token_revoked":        true,
+	"missing_scope":        true,
+}
+
+// webError is returned when Slack answers a call to the Web API with an
+// error, e.g. channel_not_found. When Slack limits the rate of the calls the
+// code is "ratelimited" and retryAfter is how long it asked us to wait.
+type webError struct {
+	method     string
+	code       string
+	retryAfter time.Duration
+}
+
+func (e *webError) Error() string {
+	return fmt.Sprintf("webapi: %s: %s", e.method, e.code)
+}
+
+// permanent reports whether Slack will answer with the same error if the call
+// is made again, see webPermanentErrors.
+func (e *webError) permanent() bool {
+	return webPermanentErrors[e.code]
+}
+
+// retryAfter returns how long Slack asked us to wait before the next call
+// when err is a webError, zero otherwise.
+func retryAfter(err error) time.Duration {
+	if e, ok := err.(*webError); ok {
+		return e.retryAfter
+	}
+	return 0
+}
+
+// webClient implements the slackWebClient interface. The vendored client knows
+// about threads but not about broadcasts, it can not update the attachments of
+// a message and it does not return the error codes of Slack, so the requests
+// are made here, to the same slack.SLACK_API.
+type webClient struct {
+	token string
+	http  *http.Client
+}
+
+func newWebClient(token string) *webClient {
+	return &webClient{
+		token: token,
+		http:  &http.Client{Timeout: webTimeout},
+	}
+}
+
+// PostMessage posts the message with chat.postMessage and returns its
+// timestamp. The message is posted as the bot user unless it changes its name
+// or icon.
+func (c *webClient) PostMessage(msg *OutgoingMessage) (string, error) {
+	values, err := messageValues(msg)
+	if err != nil {
+		return "", err
+	}
+	values.Set("channel", msg.Channel)
+	if msg.ThreadTimestamp != "" {
+		values.Set("thread_ts", msg.ThreadTimestamp)
+		if msg.Broadcast {
+			values.Set("reply_broadcast", "true")
+		}
+	}
+	if msg.Username != "" {
+		values.Set("username", msg.Username)
+	}
+	if msg.IconURL != "" {
+		values.Set("icon_url", msg.IconURL)
+	}
+	if msg.IconEmoji != "" {
+		values.Set("icon_emoji", msg.IconEmoji)
+	}
+	if msg.Username == "" && msg.IconURL == "" && msg.IconEmoji == "" {
+		values.Set("as_user", "true")
+	}
+
+	var res struct {
+		Timestamp string `json:"ts"`
+	}
+	if err := c.call("chat.postMessage", values, &res); err != nil {
+		if e, ok := err.(*webError); ok && e.code == "msg_too_long" {
+			// Let the messenger split it like the messages
+			// posted through the RTM API.
+			return "", &slack.MessageTooLongEvent{
+				Message:   slack.OutgoingMessage{Channel: msg.Channel, Text: msg.Text},
+				MaxLength: slack.MaxMessageTextLength,
+			}
+		}
+		return "", err
+	}
+	return res.Timestamp, nil
+}
+
+// UpdateMessage replaces the text and the attachments of a message with
+// chat.update.
+func (c *webClient) UpdateMessage(channel, ts string, msg *OutgoingMessage) error {
+	values, err := messageValues(msg)
+	if err != nil {
+		return err
+	}
+	values.Set("channel", channel)
+	values.Set("ts", ts)
+	values.Set("as_user", "true")
+	return c.call("chat.update", values, nil)
+}
+
+// DeleteMessage removes a message with chat.delete.
+func (c *webClient) DeleteMessage(channel, ts string) error {
+	return c.call("chat.delete", url.Values{
+		"channel": {channel},
+		"ts":      {ts},
+		"as_user": {"true"},
+	}, nil)
+}
+
+// AddReaction adds the reaction, an emoji name without colons, to a message
+// with reactions.add.
+func (c *webClient) AddReaction(channel, ts, name string) error {
+	err := c.call("reactions.add", url.Values{
+		"channel":   {channel},
+		"timestamp": {ts},
+		"name":      {name},
+	}, nil)
+	if e, ok := err.(*webError); ok && e.code == "already_reacted" {
+		return nil
+	}
+	return err
+}
+
+// messageValues returns the parameters shared by the methods that post and
+// update messages.
+func messageValues(msg *OutgoingMessage) (url.Values, error) {
+	values := url.Values{"text": {msg.Text}}
+	if len(msg.Attachments) > 0 {
+		b, err := json.Marshal(msg.Attachments)
+		if err != nil {
+			return nil, err
+		}
+		values.Set("attachments", string(b))
+	}
+	return values, nil
+}
+
+// call calls the method with the values given and decodes the response in v,
+// which can be nil.
+func (c *webClient) call(method string, values url.Values, v interface{}) error {
+	values.Set("token", c.token)
+	resp, err := c.http.PostForm(slack.SLACK_API+method, values)
+	if err != nil {
+		return fmt.Errorf("webapi: %s: %s", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// Retry-After is given in seconds.
+		secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return &webError{method: method, code: "ratelimited", retryAfter: time.Duration(secs) * time.Second}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webapi: %s: %s", method, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("webapi: %s: %s", method, err)
+	}
+
+	var res slack.SlackResponse
+	if err := json.Unmarshal(b, &res); err != nil {
+		return fmt.Errorf("webapi: %s: %s", method, err)
+	}
+	if !res.Ok {
+		return &webError{method: method, code: res.Error}
+	}
+	if v != nil {
+		if err := json.Unmarshal(b, v); err != nil {
+			return fmt.Errorf("webapi: %s: %s", method, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package qubot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"testutil"
+
+	"github.com/nlopes/slack"
+	"github.com/sony/gobreaker"
+	"golang.org/x/net/context"
+)
+
+// fakeWebAPI is an in-process Slack Web API. Every call is recorded along
+// with its parameters and answered with a new timestamp, unless the method has
+// been told to fail or the rate of the calls is limited.
+type fakeWebAPI struct {
+	*httptest.Server
+	mu      sync.Mutex
+	calls   []webCall
+	errs    map[string]string
+	limited int
+	seq     int
+}
+
+// webCall is a call received by the fake Web API.
+type webCall struct {
+	method string
+	values url.Values
+}
+
+func newFakeWebAPI() *fakeWebAPI {
+	f := &fakeWebAPI{errs: make(map[string]string)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	slack.SLACK_API = f.URL + "/api/"
+	return f
+}
+
+func (f *fakeWebAPI) serve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, "/api/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, webCall{method: method, values: r.PostForm})
+	if f.limited > 0 {
+		f.limited--
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	if code, ok := f.errs[method]; ok {
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error": code})
+		return
+	}
+	f.seq++
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":      true,
+		"channel": r.PostForm.Get("channel"),
+		"ts":      fmt.Sprintf("2000.%02d", f.seq),
+	})
+}
+
+// fail makes the method answer with the error code given.
+func (f *fakeWebAPI) fail(method, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[method] = code
+}
+
+// limit answers the next n calls with 429 Too Many Requests.
+func (f *fakeWebAPI) limit(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.limited = n
+}
+
+func (f *fakeWebAPI) received() []webCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]webCall(nil), f.calls...)
+}
+
+// Ensure that the client sends the parameters of each method and returns the
+// errors of Slack.
+func TestWebClient(t *testing.T) {
+	f := newFakeWebAPI()
+	defer f.Close()
+	c := newWebClient("xoxb-test")
+
+	attachments := []Attachment{{
+		Title:    "Bug #42",
+		Fallback: "Bug #42: it crashes",
+		Color:    "danger",
+		Fields:   []AttachmentField{{Title: "Status", Value: "New", Short: true}},
+	}}
+	ts, err := c.PostMessage(&OutgoingMessage{
+		Channel:         "C100",
+		Text:            "Issue updated",
+		ThreadTimestamp: "1000.01",
+		Broadcast:       true,
+		Username:        "redmine",
+		IconEmoji:       ":bug:",
+		Attachments:     attachments,
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "2000.01", ts)
+
+	testutil.Ok(t, c.UpdateMessage("C100", ts, &OutgoingMessage{Text: "Issue closed"}))
+	testutil.Ok(t, c.AddReaction("C100", ts, "white_check_mark"))
+	testutil.Ok(t, c.DeleteMessage("C100", ts))
+
+	calls := f.received()
+	testutil.Equals(t, 4, len(calls))
+
+	post := calls[0]
+	testutil.Equals(t, "chat.postMessage", post.method)
+	testutil.Equals(t, "xoxb-test", post.values.Get("token"))
+	testutil.Equals(t, "C100", post.values.Get("channel"))
+	testutil.Equals(t, "Issue updated", post.values.Get("text"))
+	testutil.Equals(t, "1000.01", post.values.Get("thread_ts"))
+	testutil.Equals(t, "true", post.values.Get("reply_broadcast"))
+	testutil.Equals(t, "redmine", post.values.Get("username"))
+	testutil.Equals(t, ":bug:", post.values.Get("icon_emoji"))
+	testutil.Equals(t, "", post.values.Get("as_user"))
+	var sent []Attachment
+	testutil.Ok(t, json.Unmarshal([]byte(post.values.Get("attachments")), &sent))
+	testutil.Equals(t, attachments, sent)
+
+	testutil.Equals(t, "chat.update", calls[1].method)
+	testutil.Equals(t, "2000.01", calls[1].values.Get("ts"))
+	testutil.Equals(t, "Issue closed", calls[1].values.Get("text"))
+	testutil.Equals(t, "reactions.add", calls[2].method)
+	testutil.Equals(t, "2000.01", calls[2].values.Get("timestamp"))
+	testutil.Equals(t, "white_check_mark", calls[2].values.Get("name"))
+	testutil.Equals(t, "chat.delete", calls[3].method)
+	testutil.Equals(t, "2000.01", calls[3].values.Get("ts"))
+
+	f.fail("chat.delete", "message_not_found")
+	testutil.Equals(t, &webError{method: "chat.delete", code: "message_not_found"}, c.DeleteMessage("C100", ts))
+
+	f.limit(1)
+	testutil.Equals(t, &webError{method: "chat.delete", code: "ratelimited", retryAfter: time.Second}, c.DeleteMessage("C100", ts))
+
+	f.fail("reactions.add", "already_reacted")
+	testutil.Ok(t, c.AddReaction("C100", ts, "white_check_mark"))
+
+	f.fail("chat.postMessage", "msg_too_long")
+	_, err = c.PostMessage(&OutgoingMessage{Channel: "C100", Text: "long", Username: "redmine"})
+	_, ok := err.(*slack.MessageTooLongEvent)
+	testutil.Assert(t, ok, "expected MessageTooLongEvent, got %v", err)
+}
+
+// Ensure that rich messages are posted through the Web API, in order with the
+// plain ones, and that the permanent errors of Slack are not retried.
+func TestMessenger_webAPI(t *testing.T) {
+	f := newFakeWebAPI()
+	defer f.Close()
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+	m.web = newWebClient("xoxb-test")
+
+	testutil.Ok(t, send(m, &OutgoingMessage{Channel: "C100", Text: "plain"}))
+	d, err := m.Send(&OutgoingMessage{
+		Channel:     "C100",
+		Text:        "rich",
+		Attachments: []Attachment{{Fallback: "card"}},
+	})
+	testutil.Ok(t, err)
+	testutil.Ok(t, d.Wait(context.Background()))
+	testutil.Equals(t, "2000.01", d.Timestamp())
+
+	testutil.Equals(t, 1, len(rtm.sent))
+	testutil.Equals(t, "plain", (<-rtm.sent).Text)
+	calls := f.received()
+	testutil.Equals(t, 1, len(calls))
+	testutil.Equals(t, "rich", calls[0].values.Get("text"))
+
+	f.fail("chat.postMessage", "channel_not_found")
+	d, err = m.Send(&OutgoingMessage{Channel: "C200", Text: "rich", Broadcast: true, ThreadTimestamp: "1000.01"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, &webError{method: "chat.postMessage", code: "channel_not_found"}, d.Wait(context.Background()))
+	testutil.Equals(t, 2, len(f.received()))
+	testutil.Equals(t, gobreaker.StateClosed, m.breaker("C200").State())
+}
+
+// Ensure that the errors of the Web API that are not permanent are retried and
+// that the messenger waits as long as Slack asks when it limits the rate.
+func TestMessenger_webAPIRetry(t *testing.T) {
+	f := newFakeWebAPI()
+	defer f.Close()
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+	m.web = newWebClient("xoxb-test")
+	m.backoffMin = time.Millisecond
+	m.retries = 1
+
+	rich := &OutgoingMessage{Channel: "C100", Text: "rich", Attachments: []Attachment{{Fallback: "card"}}}
+	f.limit(1)
+	start := time.Now()
+	d, err := m.Send(rich)
+	testutil.Ok(t, err)
+	testutil.Ok(t, d.Wait(context.Background()))
+	testutil.Assert(t, time.Since(start) >= time.Second, "the retry should wait for Retry-After")
+	testutil.Equals(t, 2, len(f.received()))
+
+	f.fail("chat.postMessage", "internal_error")
+	d, err = m.Send(rich)
+	testutil.Ok(t, err)
+	testutil.Equals(t, &webError{method: "chat.postMessage", code: "internal_error"}, d.Wait(context.Background()))
+	testutil.Equals(t, 4, len(f.received()))
+}
+
+// Ensure that the messenger changes and reacts to messages through the Web
+// API.
+func TestMessenger_edit(t *testing.T) {
+	rtm := newFakeSlackRTMClient()
+	m, cancel := newTestMessenger(rtm, nil, fastMessengerConfig)
+	defer m.Close()
+	defer cancel()
+	testutil.Equals(t, errWebUnavailable, m.React("C100", "1000.01", "eyes"))
+
+	f := newFakeWebAPI()
+	defer f.Close()
+	m.web = newWebClient("xoxb-test")
+
+	testutil.Ok(t, m.Update("C100", "1000.01", &OutgoingMessage{Text: "edited"}))
+	testutil.Ok(t, m.React("C100", "1000.01", ":eyes:"))
+	testutil.Ok(t, m.Delete("C100", "1000.01"))
+
+	var methods []string
+	for _, c := range f.received() {
+		methods = append(methods, c.method)
+	}
+	testutil.Equals(t, []string{"chat.update", "reactions.add", "chat.delete"}, methods)
+	testutil.Equals(t, "eyes", f.received()[1].values.Get("name"))
+}